@@ -0,0 +1,189 @@
+package gcsmiddleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Errors returned (or wrapped) by a Backend so the middleware can tell a missing file
+// apart from other failures and answer with a matching status code. Any other error
+// is treated as an upstream failure.
+var (
+	// ErrObjectNotExist is returned when the requested object does not exist
+	ErrObjectNotExist = errors.New("gcsmiddleware: object does not exist")
+
+	// ErrPermissionDenied is returned when the backend is not allowed to read the object
+	ErrPermissionDenied = errors.New("gcsmiddleware: permission denied")
+
+	// ErrUnauthenticated is returned when the backend's credentials are missing or invalid
+	ErrUnauthenticated = errors.New("gcsmiddleware: unauthenticated")
+
+	// ErrTimeout is returned when the backend did not answer in time
+	ErrTimeout = errors.New("gcsmiddleware: backend timed out")
+)
+
+// ObjectAttrs holds the metadata of a stored object as reported by a Backend.
+// It mirrors the subset of storage.ObjectAttrs the middleware relies on, so that
+// non-GCS backends can provide the same information.
+type ObjectAttrs struct {
+	// Name is the name of the object within the backend
+	Name string
+
+	// ContentType is the MIME type stored with the object, if any
+	ContentType string
+
+	// ContentEncoding is the encoding the object is stored with (e.g. "gzip")
+	ContentEncoding string
+
+	// Size is the length of the object's content in bytes
+	Size int64
+
+	// Etag is the HTTP/1.1 entity tag reported by the backend
+	Etag string
+
+	// Generation is the generation number of the object's content
+	Generation int64
+
+	// Updated is the time the object was last modified
+	Updated time.Time
+
+	// CRC32C is the CRC32 checksum of the object's content using the Castagnoli polynomial
+	CRC32C uint32
+
+	// MD5 is the MD5 hash of the object's content, if known
+	MD5 []byte
+
+	// Metadata holds user-provided metadata as key/value pairs
+	Metadata map[string]string
+}
+
+// Backend defines the storage operations the middleware needs in order to serve files.
+// The default implementation talks to Google Cloud Storage, but any source can be
+// plugged in through GCSStaticConfig.Backend, which also makes the middleware testable
+// without network access.
+type Backend interface {
+	// Stat returns the attributes of the named object.
+	// It returns ErrObjectNotExist if the object does not exist.
+	Stat(ctx context.Context, name string) (*ObjectAttrs, error)
+
+	// Open returns a reader for the full contents of the named object as they are
+	// stored, so an object with a ContentEncoding is not decoded and its length
+	// matches Size. The caller is responsible for closing the reader.
+	// It returns ErrObjectNotExist if the object does not exist.
+	Open(ctx context.Context, name string) (io.ReadCloser, error)
+
+	// List returns the attributes of all objects whose names begin with prefix
+	List(ctx context.Context, prefix string) ([]*ObjectAttrs, error)
+}
+
+// RangeBackend is implemented by backends that can read part of an object without
+// reading the bytes before it. Backends that do not implement it are read from the
+// start and the bytes before the range are discarded.
+type RangeBackend interface {
+	// OpenRange returns a reader for length bytes of the named object starting at offset.
+	// The caller is responsible for closing the reader.
+	OpenRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error)
+}
+
+// openRange returns a reader for length bytes of the named object starting at offset,
+// using the backend's OpenRange if it is a RangeBackend
+func openRange(ctx context.Context, backend Backend, name string, offset, length int64) (io.ReadCloser, error) {
+	if rb, ok := backend.(RangeBackend); ok {
+		return rb.OpenRange(ctx, name, offset, length)
+	}
+
+	reader, err := backend.Open(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(io.Discard, reader, offset); err != nil {
+		reader.Close()
+		return nil, err
+	}
+	return limitReadCloser(reader, length), nil
+}
+
+// GenerationBackend is implemented by backends that can read a given generation of
+// an object, so that the content read matches the attributes returned by an earlier
+// Stat even if the object has been replaced in the meantime
+type GenerationBackend interface {
+	// OpenGeneration is like Open, but reads the given generation of the object.
+	// It returns ErrObjectNotExist if the generation no longer exists.
+	OpenGeneration(ctx context.Context, name string, generation int64) (io.ReadCloser, error)
+
+	// OpenRangeGeneration is like OpenRange, but reads the given generation of the object
+	OpenRangeGeneration(ctx context.Context, name string, generation, offset, length int64) (io.ReadCloser, error)
+}
+
+// errGenerationReplaced is returned when a generation of an object can no longer be
+// read because the object has been replaced or deleted since its attributes were
+// retrieved. It does not wrap ErrObjectNotExist, as the object itself may well exist:
+// its attributes have to be retrieved again before it can be served.
+var errGenerationReplaced = errors.New("gcsmiddleware: object generation was replaced")
+
+// openGeneration returns a reader for the full contents of the given generation of
+// the named object, using the backend's OpenGeneration if it is a GenerationBackend.
+// A zero generation stands for the latest one. A generation that no longer exists
+// is reported as errGenerationReplaced.
+func openGeneration(ctx context.Context, backend Backend, name string, generation int64) (io.ReadCloser, error) {
+	if gb, ok := backend.(GenerationBackend); ok && generation != 0 {
+		reader, err := gb.OpenGeneration(ctx, name, generation)
+		return reader, generationError(err, name, generation)
+	}
+	return backend.Open(ctx, name)
+}
+
+// openRangeGeneration returns a reader for length bytes of the given generation of
+// the named object starting at offset, using the backend's OpenRangeGeneration if it
+// is a GenerationBackend. A zero generation stands for the latest one. A generation
+// that no longer exists is reported as errGenerationReplaced.
+func openRangeGeneration(ctx context.Context, backend Backend, name string, generation, offset, length int64) (io.ReadCloser, error) {
+	if gb, ok := backend.(GenerationBackend); ok && generation != 0 {
+		reader, err := gb.OpenRangeGeneration(ctx, name, generation, offset, length)
+		return reader, generationError(err, name, generation)
+	}
+	return openRange(ctx, backend, name, offset, length)
+}
+
+// generationError replaces ErrObjectNotExist from reading a generation of the named
+// object with errGenerationReplaced
+func generationError(err error, name string, generation int64) error {
+	if !isNotExist(err) {
+		return err
+	}
+	return fmt.Errorf("%w: %s#%d", errGenerationReplaced, name, generation)
+}
+
+// StaleBackend is implemented by backends that may answer with attributes that are
+// no longer current, such as a cache serving an object while it is revalidated
+type StaleBackend interface {
+	// StatStale is like Stat, but also reports whether the attributes are stale
+	StatStale(ctx context.Context, name string) (*ObjectAttrs, bool, error)
+}
+
+// statStale returns the attributes of the named object and whether they are stale,
+// using the backend's StatStale if it is a StaleBackend
+func statStale(ctx context.Context, backend Backend, name string) (*ObjectAttrs, bool, error) {
+	if sb, ok := backend.(StaleBackend); ok {
+		return sb.StatStale(ctx, name)
+	}
+	attrs, err := backend.Stat(ctx, name)
+	return attrs, false, err
+}
+
+// limitedReadCloser limits the bytes read from a ReadCloser while still closing it
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// limitReadCloser returns a ReadCloser that reads at most n bytes from rc
+func limitReadCloser(rc io.ReadCloser, n int64) io.ReadCloser {
+	return limitedReadCloser{
+		Reader: io.LimitReader(rc, n),
+		Closer: rc,
+	}
+}
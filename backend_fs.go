@@ -0,0 +1,162 @@
+package gcsmiddleware
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+)
+
+// FSBackend is a Backend that serves objects from an fs.FS such as an embed.FS.
+// It allows assets baked into the binary to be served through the same middleware
+// as assets stored in GCS.
+type FSBackend struct {
+	fsys   fs.FS
+	hashes sync.Map // of file name to the MD5 hash of its content
+}
+
+// NewFSBackend returns a Backend that reads objects from the given file system.
+// Use fs.Sub to serve a subdirectory of an embed.FS as the bucket root.
+//
+// Parameters:
+//   - fsys: The file system whose contents mirror the bucket layout
+//
+// Returns:
+//   - *FSBackend that can be set as GCSStaticConfig.Backend
+func NewFSBackend(fsys fs.FS) *FSBackend {
+	return &FSBackend{
+		fsys: fsys,
+	}
+}
+
+// Stat returns the attributes of the named file.
+// Directories are reported as ErrObjectNotExist, as they are in a bucket.
+// Files without a modification time, such as those of an embed.FS, are identified
+// by the MD5 hash of their content instead, so that each gets its own ETag.
+func (b *FSBackend) Stat(_ context.Context, name string) (*ObjectAttrs, error) {
+	name = fsName(name)
+	info, err := fs.Stat(b.fsys, name)
+	if err != nil {
+		return nil, fsError(err)
+	}
+	if info.IsDir() {
+		return nil, ErrObjectNotExist
+	}
+	attrs := fromFileInfo(name, info)
+	if info.ModTime().IsZero() {
+		if attrs.MD5, err = b.hash(name); err != nil {
+			return nil, fsError(err)
+		}
+	}
+	return attrs, nil
+}
+
+// hash returns the MD5 hash of the content of the named file. A file without a
+// modification time cannot be told apart from a changed one, so it is assumed not
+// to change, as in an embed.FS, and is only hashed the first time.
+func (b *FSBackend) hash(name string) ([]byte, error) {
+	if sum, ok := b.hashes.Load(name); ok {
+		return sum.([]byte), nil
+	}
+	file, err := b.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	h := md5.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return nil, err
+	}
+	sum := h.Sum(nil)
+	b.hashes.Store(name, sum)
+	return sum, nil
+}
+
+// Open returns a reader for the full contents of the named file
+func (b *FSBackend) Open(_ context.Context, name string) (io.ReadCloser, error) {
+	file, err := b.fsys.Open(fsName(name))
+	if err != nil {
+		return nil, fsError(err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fsError(err)
+	}
+	if info.IsDir() {
+		file.Close()
+		return nil, ErrObjectNotExist
+	}
+	return file, nil
+}
+
+// OpenRange returns a reader for length bytes of the named file starting at offset.
+// Files that implement io.Seeker, such as those of an embed.FS, are not read
+// before the offset.
+func (b *FSBackend) OpenRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	reader, err := b.Open(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if seeker, ok := reader.(io.Seeker); ok {
+		_, err = seeker.Seek(offset, io.SeekStart)
+	} else {
+		_, err = io.CopyN(io.Discard, reader, offset)
+	}
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+	return limitReadCloser(reader, length), nil
+}
+
+// List returns the attributes of all files whose names begin with prefix
+func (b *FSBackend) List(_ context.Context, prefix string) ([]*ObjectAttrs, error) {
+	var objects []*ObjectAttrs
+	err := fs.WalkDir(b.fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, fromFileInfo(name, info))
+		return nil
+	})
+	if err != nil {
+		return nil, fsError(err)
+	}
+	return objects, nil
+}
+
+// fsName converts an object name into a name accepted by fs.FS.
+// The name is cleaned as an absolute path so that ".." segments cannot
+// escape the root, and the leading slash is then removed.
+func fsName(name string) string {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+// fsError translates file system errors into backend errors
+func fsError(err error) error {
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrInvalid) {
+		return ErrObjectNotExist
+	}
+	if errors.Is(err, fs.ErrPermission) {
+		return fmt.Errorf("%w: %w", ErrPermissionDenied, err)
+	}
+	return err
+}
@@ -0,0 +1,131 @@
+package gcsmiddleware
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestFSBackend tests Stat, Open and List of FSBackend
+func TestFSBackend(t *testing.T) {
+	backend := NewFSBackend(fstest.MapFS{
+		"index.html":     {Data: []byte("<html></html>")},
+		"js/app.js":      {Data: []byte("console.log(1)")},
+		"js/vendor.js":   {Data: []byte("var v")},
+		"img/banner.png": {Data: []byte("\x89PNG")},
+	})
+	ctx := context.Background()
+
+	attrs, err := backend.Stat(ctx, "js/app.js")
+	assert.NoError(t, err)
+	assert.Equal(t, "js/app.js", attrs.Name)
+	assert.Equal(t, int64(14), attrs.Size)
+
+	// Leading slashes and ".." segments are cleaned
+	attrs, err = backend.Stat(ctx, "/js/../index.html")
+	assert.NoError(t, err)
+	assert.Equal(t, "index.html", attrs.Name)
+
+	reader, err := backend.Open(ctx, "js/app.js")
+	assert.NoError(t, err)
+	data, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.NoError(t, reader.Close())
+	assert.Equal(t, "console.log(1)", string(data))
+
+	_, err = backend.Stat(ctx, "missing.js")
+	assert.ErrorIs(t, err, ErrObjectNotExist)
+
+	_, err = backend.Open(ctx, "missing.js")
+	assert.ErrorIs(t, err, ErrObjectNotExist)
+
+	_, err = backend.Stat(ctx, "js")
+	assert.ErrorIs(t, err, ErrObjectNotExist)
+
+	_, err = backend.Open(ctx, "")
+	assert.ErrorIs(t, err, ErrObjectNotExist)
+
+	objects, err := backend.List(ctx, "js/")
+	assert.NoError(t, err)
+	var names []string
+	for _, object := range objects {
+		names = append(names, object.Name)
+	}
+	sort.Strings(names)
+	assert.Equal(t, []string{"js/app.js", "js/vendor.js"}, names)
+}
+
+// TestFSBackendServing tests serving an fs.FS through the ServerHeader pipeline
+func TestFSBackendServing(t *testing.T) {
+	index := strings.Repeat("<p>embedded</p>", 100)
+	config := GCSStaticConfig{
+		Backend: NewFSBackend(fstest.MapFS{
+			"index.html": {Data: []byte(index)},
+		}),
+		RootPath:          "/app/",
+		IsSPA:             true,
+		EnableCompression: true,
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/app/settings/profile", nil)
+	rec := serve(config, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "text/html", rec.Header().Get(echo.HeaderContentType))
+	assert.Equal(t, strconv.Itoa(len(index)), rec.Header().Get(echo.HeaderContentLength))
+	assert.Equal(t, index, rec.Body.String())
+
+	req = httptest.NewRequest(http.MethodGet, "/app/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec = serve(config, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "gzip", rec.Header().Get(echo.HeaderContentEncoding))
+	assert.Equal(t, strconv.Itoa(rec.Body.Len()), rec.Header().Get(echo.HeaderContentLength))
+
+	gz, err := gzip.NewReader(rec.Body)
+	assert.NoError(t, err)
+	decompressed, err := io.ReadAll(gz)
+	assert.NoError(t, err)
+	assert.Equal(t, index, string(decompressed))
+}
+
+// TestFSBackendEntityTags tests that files without a modification time, as in an
+// embed.FS, get an ETag derived from their content
+func TestFSBackendEntityTags(t *testing.T) {
+	config := GCSStaticConfig{
+		Backend: NewFSBackend(fstest.MapFS{
+			"a.js": {Data: []byte("console.log('a')")},
+			"b.js": {Data: []byte("console.log('b')")},
+		}),
+		RootPath: "/",
+	}
+	get := func(target, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		return serve(config, req)
+	}
+
+	a, b := get("/a.js", ""), get("/b.js", "")
+	sum := md5.Sum([]byte("console.log('a')"))
+	assert.Equal(t, `"`+hex.EncodeToString(sum[:])+`"`, a.Header().Get("ETag"))
+	assert.NotEqual(t, a.Header().Get("ETag"), b.Header().Get("ETag"))
+	assert.Empty(t, a.Header().Get("Last-Modified"))
+
+	assert.Equal(t, http.StatusNotModified, get("/a.js", a.Header().Get("ETag")).Code)
+	rec := get("/b.js", a.Header().Get("ETag"))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "console.log('b')", rec.Body.String())
+}
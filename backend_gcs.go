@@ -0,0 +1,151 @@
+package gcsmiddleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// GCSBackend is a Backend that serves objects from a Google Cloud Storage bucket.
+type GCSBackend struct {
+	bucket *storage.BucketHandle
+}
+
+// NewGCSBackend returns a Backend that reads objects from the named bucket
+// using the provided Google Cloud Storage client.
+//
+// Parameters:
+//   - client: The initialized Google Cloud Storage client
+//   - bucketName: The name of the GCS bucket to serve files from
+//
+// Returns:
+//   - *GCSBackend that can be set as GCSStaticConfig.Backend
+func NewGCSBackend(client *storage.Client, bucketName string) *GCSBackend {
+	return &GCSBackend{
+		bucket: client.Bucket(bucketName),
+	}
+}
+
+// Stat returns the attributes of the named object in the bucket
+func (b *GCSBackend) Stat(ctx context.Context, name string) (*ObjectAttrs, error) {
+	attrs, err := b.bucket.Object(name).Attrs(ctx)
+	if err != nil {
+		return nil, gcsError(err)
+	}
+	return fromStorageAttrs(attrs), nil
+}
+
+// Open returns a reader for the full contents of the named object in the bucket.
+// Objects stored with Content-Encoding: gzip are read as they are stored instead
+// of being decompressed by GCS.
+func (b *GCSBackend) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	reader, err := b.bucket.Object(name).ReadCompressed(true).NewReader(ctx)
+	if err != nil {
+		return nil, gcsError(err)
+	}
+	return reader, nil
+}
+
+// OpenRange returns a reader for length bytes of the named object starting at offset.
+// Only the requested bytes are downloaded from GCS.
+func (b *GCSBackend) OpenRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	reader, err := b.bucket.Object(name).ReadCompressed(true).NewRangeReader(ctx, offset, length)
+	if err != nil {
+		return nil, gcsError(err)
+	}
+	return reader, nil
+}
+
+// OpenGeneration returns a reader for the full contents of the given generation of
+// the named object. Generations that have been replaced are only kept by buckets
+// with object versioning enabled.
+func (b *GCSBackend) OpenGeneration(ctx context.Context, name string, generation int64) (io.ReadCloser, error) {
+	reader, err := b.bucket.Object(name).Generation(generation).ReadCompressed(true).NewReader(ctx)
+	if err != nil {
+		return nil, gcsError(err)
+	}
+	return reader, nil
+}
+
+// OpenRangeGeneration returns a reader for length bytes of the given generation of
+// the named object starting at offset
+func (b *GCSBackend) OpenRangeGeneration(ctx context.Context, name string, generation, offset, length int64) (io.ReadCloser, error) {
+	reader, err := b.bucket.Object(name).Generation(generation).ReadCompressed(true).NewRangeReader(ctx, offset, length)
+	if err != nil {
+		return nil, gcsError(err)
+	}
+	return reader, nil
+}
+
+// List returns the attributes of all objects in the bucket whose names begin with prefix
+func (b *GCSBackend) List(ctx context.Context, prefix string) ([]*ObjectAttrs, error) {
+	var objects []*ObjectAttrs
+	it := b.bucket.Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return nil, gcsError(err)
+		}
+		objects = append(objects, fromStorageAttrs(attrs))
+	}
+	return objects, nil
+}
+
+// gcsError translates errors from the storage package into backend errors.
+// Errors are reported by the JSON API as googleapi.Error and by the gRPC API
+// as status errors, so both are inspected. The original error stays wrapped.
+func gcsError(err error) error {
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return ErrObjectNotExist
+	}
+
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		switch apiErr.Code {
+		case http.StatusUnauthorized:
+			return fmt.Errorf("%w: %w", ErrUnauthenticated, err)
+		case http.StatusForbidden:
+			return fmt.Errorf("%w: %w", ErrPermissionDenied, err)
+		case http.StatusRequestTimeout, http.StatusGatewayTimeout:
+			return fmt.Errorf("%w: %w", ErrTimeout, err)
+		}
+		return err
+	}
+
+	switch status.Code(err) {
+	case codes.Unauthenticated:
+		return fmt.Errorf("%w: %w", ErrUnauthenticated, err)
+	case codes.PermissionDenied:
+		return fmt.Errorf("%w: %w", ErrPermissionDenied, err)
+	case codes.DeadlineExceeded:
+		return fmt.Errorf("%w: %w", ErrTimeout, err)
+	}
+	return err
+}
+
+// fromStorageAttrs converts GCS object attributes into ObjectAttrs
+func fromStorageAttrs(attrs *storage.ObjectAttrs) *ObjectAttrs {
+	return &ObjectAttrs{
+		Name:            attrs.Name,
+		ContentType:     attrs.ContentType,
+		ContentEncoding: attrs.ContentEncoding,
+		Size:            attrs.Size,
+		Etag:            attrs.Etag,
+		Generation:      attrs.Generation,
+		Updated:         attrs.Updated,
+		CRC32C:          attrs.CRC32C,
+		MD5:             attrs.MD5,
+		Metadata:        attrs.Metadata,
+	}
+}
@@ -0,0 +1,136 @@
+package gcsmiddleware
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestFiles creates the given files below dir
+func writeTestFiles(t *testing.T, dir string, files map[string][]byte) {
+	t.Helper()
+	for name, data := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestLocalBackend tests Stat, Open and List of LocalBackend
+func TestLocalBackend(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFiles(t, dir, map[string][]byte{
+		"index.html":    []byte("<html></html>"),
+		"css/style.css": []byte("body{}"),
+		"css/print.css": []byte("@media print{}"),
+	})
+	backend := NewLocalBackend(dir)
+	ctx := context.Background()
+
+	attrs, err := backend.Stat(ctx, "css/style.css")
+	assert.NoError(t, err)
+	assert.Equal(t, "css/style.css", attrs.Name)
+	assert.Equal(t, int64(6), attrs.Size)
+	assert.False(t, attrs.Updated.IsZero())
+
+	reader, err := backend.Open(ctx, "css/style.css")
+	assert.NoError(t, err)
+	data, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.NoError(t, reader.Close())
+	assert.Equal(t, "body{}", string(data))
+
+	_, err = backend.Stat(ctx, "missing.js")
+	assert.ErrorIs(t, err, ErrObjectNotExist)
+
+	_, err = backend.Open(ctx, "missing.js")
+	assert.ErrorIs(t, err, ErrObjectNotExist)
+
+	// Directories are not objects
+	_, err = backend.Stat(ctx, "css")
+	assert.ErrorIs(t, err, ErrObjectNotExist)
+
+	_, err = backend.Open(ctx, "css")
+	assert.ErrorIs(t, err, ErrObjectNotExist)
+
+	objects, err := backend.List(ctx, "css/")
+	assert.NoError(t, err)
+	var names []string
+	for _, object := range objects {
+		names = append(names, object.Name)
+	}
+	sort.Strings(names)
+	assert.Equal(t, []string{"css/print.css", "css/style.css"}, names)
+}
+
+// TestLocalBackendTraversal tests that object names cannot escape the backend directory
+func TestLocalBackendTraversal(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string][]byte{
+		"secret.txt":        []byte("secret"),
+		"public/index.html": []byte("<html></html>"),
+	})
+	backend := NewLocalBackend(filepath.Join(root, "public"))
+
+	_, err := backend.Stat(context.Background(), "../secret.txt")
+	assert.ErrorIs(t, err, ErrObjectNotExist)
+
+	_, err = backend.Open(context.Background(), "../../secret.txt")
+	assert.ErrorIs(t, err, ErrObjectNotExist)
+}
+
+// TestLocalBackendMatchesServing tests that a local directory is served exactly like
+// the same objects held by another backend
+func TestLocalBackendMatchesServing(t *testing.T) {
+	files := map[string][]byte{
+		"index.html": []byte(strings.Repeat("<p>app</p>", 200)),
+		"main.js":    []byte(strings.Repeat("console.log(1);", 200)),
+		"logo.png":   []byte("\x89PNG"),
+	}
+	dir := t.TempDir()
+	writeTestFiles(t, dir, files)
+
+	for _, target := range []string{"/", "/main.js", "/logo.png", "/dashboard", "/missing.css"} {
+		t.Run(target, func(t *testing.T) {
+			newRequest := func() *http.Request {
+				req := httptest.NewRequest(http.MethodGet, target, nil)
+				req.Header.Set("Accept-Encoding", "gzip")
+				return req
+			}
+			config := GCSStaticConfig{
+				RootPath:              "/",
+				IsSPA:                 !strings.Contains(target, "."),
+				EnableCompression:     true,
+				MinSizeForCompression: 1024,
+			}
+
+			config.Backend = NewLocalBackend(dir)
+			local := serve(config, newRequest())
+
+			config.Backend = memoryBackend(files)
+			memory := serve(config, newRequest())
+
+			// Validators are derived from the attributes each backend reports
+			for _, h := range []string{"ETag", "Last-Modified"} {
+				local.Header().Del(h)
+				memory.Header().Del(h)
+			}
+
+			assert.Equal(t, memory.Code, local.Code)
+			assert.Equal(t, memory.Header(), local.Header())
+			assert.Equal(t, memory.Body.Bytes(), local.Body.Bytes())
+		})
+	}
+}
@@ -0,0 +1,653 @@
+package gcsmiddleware
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Defaults used for the zero values of CacheConfig
+const (
+	defaultCacheMaxBytes      = 64 << 20
+	defaultCacheMaxEntries    = 10000
+	defaultCacheMaxObjectSize = 1 << 20
+	defaultCacheTTL           = time.Minute
+)
+
+// CacheConfig holds the bounds of a Cache
+type CacheConfig struct {
+	// MaxBytes is the total size of the cached object contents in bytes.
+	// Default is 64 MiB if not specified
+	MaxBytes int64
+
+	// MaxEntries is the maximum number of cached objects.
+	// Default is 10000 if not specified
+	MaxEntries int
+
+	// MaxObjectSize is the size in bytes above which the content of an object is
+	// not cached. Its attributes are still cached, and concurrent lookups of them are
+	// still coalesced, but concurrent reads of its content are not: each request
+	// streams it from the backend. Default is 1 MiB if not specified
+	MaxObjectSize int64
+
+	// TTL is how long a cached object is used before its attributes are retrieved
+	// from the backend again. Default is 1 minute if not specified
+	TTL time.Duration
+
+	// StaleWhileRevalidate is how long after its TTL an object is still served from
+	// the cache while its attributes are retrieved again in the background. Only
+	// objects whose content is cached are served stale. Zero disables serving
+	// objects while they are revalidated
+	StaleWhileRevalidate time.Duration
+
+	// StaleIfError is how long after its TTL an object is still served from the cache
+	// when retrieving its attributes again fails. Only objects whose content is cached
+	// are served stale, and an object that no longer exists never is. Zero disables
+	// serving objects when the backend fails
+	StaleIfError time.Duration
+
+	// NegativeTTL is how long an object that does not exist is remembered as missing,
+	// so that repeated requests for it, such as the client-side routes of an SPA, do
+	// not go to the backend. Missing objects are kept apart from the cached objects
+	// and count towards MaxEntries separately. Zero disables caching missing objects
+	NegativeTTL time.Duration
+}
+
+// CacheStats reports the usage of a Cache
+type CacheStats struct {
+	// Hits is the number of lookups answered from the cache
+	Hits int64
+
+	// Misses is the number of lookups that went to the backend
+	Misses int64
+
+	// Stale is the number of lookups answered with an expired object, either while
+	// it was revalidated or because the backend failed
+	Stale int64
+
+	// Entries is the number of cached objects
+	Entries int
+
+	// Bytes is the total size of the cached object contents, including their
+	// compressed representations
+	Bytes int64
+
+	// MissingEntries is the number of objects remembered as missing
+	MissingEntries int
+}
+
+// objectKey identifies an object within the buckets served through a Cache
+type objectKey struct {
+	bucket string
+	name   string
+}
+
+// cacheKey identifies a generation of an object. The content of a generation never
+// changes, so it stays valid for as long as the object keeps its generation.
+type cacheKey struct {
+	objectKey
+	generation int64
+}
+
+// missingEntry is an object that was found not to exist
+type missingEntry struct {
+	obj     objectKey
+	expires time.Time
+}
+
+// variantKey identifies a compressed representation of the content of an object
+type variantKey struct {
+	encoding string
+	level    int
+}
+
+// cacheEntry is a cached generation of an object. The content is only set once the
+// object has been read, and its compressed representations once they have been
+// compressed.
+type cacheEntry struct {
+	key      cacheKey
+	attrs    ObjectAttrs
+	body     []byte
+	variants map[variantKey][]byte
+	expires  time.Time
+}
+
+// size returns the number of bytes of content held by the entry
+func (e *cacheEntry) size() int64 {
+	size := int64(len(e.body))
+	for _, variant := range e.variants {
+		size += int64(len(variant))
+	}
+	return size
+}
+
+// Cache is an in-memory LRU cache of object attributes and contents, bounded by
+// the total size of the contents, the number of entries and a time to live.
+// Entries are keyed by bucket, object and generation, so a changed object is
+// read again as soon as its new attributes have been retrieved.
+// Concurrent misses on the same object are coalesced into a single backend request.
+// Compressed representations of the contents are cached along with them.
+// A Cache is safe for concurrent use and can be shared between middlewares.
+type Cache struct {
+	config CacheConfig
+	now    func() time.Time
+
+	mu      sync.Mutex
+	lru     *list.List // of *cacheEntry, most recently used first
+	entries map[cacheKey]*list.Element
+	latest  map[objectKey]cacheKey
+	bytes   int64
+
+	missingLRU *list.List // of *missingEntry, most recently used first
+	missing    map[objectKey]*list.Element
+
+	hits   atomic.Int64
+	misses atomic.Int64
+	stale  atomic.Int64
+
+	group singleflight.Group
+}
+
+// NewCache returns an empty Cache with the given bounds
+func NewCache(config CacheConfig) *Cache {
+	if config.MaxBytes == 0 {
+		config.MaxBytes = defaultCacheMaxBytes
+	}
+	if config.MaxEntries == 0 {
+		config.MaxEntries = defaultCacheMaxEntries
+	}
+	if config.MaxObjectSize == 0 {
+		config.MaxObjectSize = defaultCacheMaxObjectSize
+	}
+	if config.TTL == 0 {
+		config.TTL = defaultCacheTTL
+	}
+	return &Cache{
+		config:  config,
+		now:     time.Now,
+		lru:     list.New(),
+		entries: make(map[cacheKey]*list.Element),
+		latest:  make(map[objectKey]cacheKey),
+
+		missingLRU: list.New(),
+		missing:    make(map[objectKey]*list.Element),
+	}
+}
+
+// Stats returns the hit and miss counts and the current size of the cache
+func (c *Cache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{
+		Hits:    c.hits.Load(),
+		Misses:  c.misses.Load(),
+		Stale:   c.stale.Load(),
+		Entries: c.lru.Len(),
+		Bytes:   c.bytes,
+
+		MissingEntries: c.missingLRU.Len(),
+	}
+}
+
+// get returns the attributes and, if it has been read, the content of the
+// latest generation of an object, unless it is not cached or has expired
+func (c *Cache) get(obj objectKey) (*ObjectAttrs, []byte, bool) {
+	attrs, body, age, ok := c.lookup(obj)
+	if !ok || age > 0 {
+		return nil, nil, false
+	}
+	return attrs, body, true
+}
+
+// getStale is like get, but also returns an object that expired at most
+// maxStale ago
+func (c *Cache) getStale(obj objectKey, maxStale time.Duration) (*ObjectAttrs, []byte, bool) {
+	attrs, body, age, ok := c.lookup(obj)
+	if !ok || age > maxStale {
+		return nil, nil, false
+	}
+	return attrs, body, true
+}
+
+// lookup returns the attributes and content of the latest generation of an
+// object along with how long ago it expired, which is not positive while it is fresh
+func (c *Cache) lookup(obj objectKey) (*ObjectAttrs, []byte, time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[c.latest[obj]]
+	if !ok {
+		return nil, nil, 0, false
+	}
+	entry := el.Value.(*cacheEntry)
+	c.lru.MoveToFront(el)
+	attrs := entry.attrs
+	return &attrs, entry.body, c.now().Sub(entry.expires), true
+}
+
+// getGeneration returns the attributes and, if it has been read, the content of a
+// generation of an object, whether or not it has expired
+func (c *Cache) getGeneration(key cacheKey) (*ObjectAttrs, []byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, nil, false
+	}
+	entry := el.Value.(*cacheEntry)
+	c.touch(el)
+	attrs := entry.attrs
+	return &attrs, entry.body, true
+}
+
+// removeGeneration drops a generation of an object from the cache
+func (c *Cache) removeGeneration(key cacheKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+}
+
+// maxStale returns how long after its TTL an object may be served at all
+func (c *Cache) maxStale() time.Duration {
+	return max(c.config.StaleWhileRevalidate, c.config.StaleIfError)
+}
+
+// putAttrs stores the attributes of the latest generation of an object. The content
+// of the generation is kept if it is cached already. The previous generation of the
+// object is kept for the requests that are still being answered with it, but is
+// the first entry to be evicted.
+func (c *Cache) putAttrs(obj objectKey, attrs *ObjectAttrs) {
+	key := cacheKey{objectKey: obj, generation: attrs.Generation}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.missing[obj]; ok {
+		c.removeMissing(el)
+	}
+	if old, ok := c.latest[obj]; ok && old != key {
+		if el, ok := c.entries[old]; ok {
+			c.lru.MoveToBack(el)
+		}
+	}
+	c.latest[obj] = key
+
+	el, ok := c.entries[key]
+	if !ok {
+		el = c.lru.PushFront(&cacheEntry{key: key})
+		c.entries[key] = el
+	}
+	entry := el.Value.(*cacheEntry)
+	entry.attrs = *attrs
+	entry.expires = c.now().Add(c.config.TTL)
+	c.lru.MoveToFront(el)
+	c.evict()
+}
+
+// putBody stores the content of a generation of an object whose attributes are cached
+func (c *Cache) putBody(obj objectKey, generation int64, body []byte) {
+	if int64(len(body)) > c.config.MaxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[cacheKey{objectKey: obj, generation: generation}]
+	if !ok {
+		return
+	}
+	entry := el.Value.(*cacheEntry)
+	if entry.body != nil {
+		return
+	}
+	entry.body = body
+	c.bytes += int64(len(body))
+	c.touch(el)
+	c.evict()
+}
+
+// isMissing reports whether an object is remembered as missing
+func (c *Cache) isMissing(obj objectKey) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.missing[obj]
+	if !ok {
+		return false
+	}
+	if c.now().After(el.Value.(*missingEntry).expires) {
+		c.removeMissing(el)
+		return false
+	}
+	c.missingLRU.MoveToFront(el)
+	return true
+}
+
+// putMissing drops the cached generations of an object that no longer exists and,
+// if NegativeTTL is set, remembers it as missing
+func (c *Cache) putMissing(obj objectKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[c.latest[obj]]; ok {
+		c.remove(el)
+	}
+	if c.config.NegativeTTL <= 0 {
+		return
+	}
+
+	el, ok := c.missing[obj]
+	if !ok {
+		el = c.missingLRU.PushFront(&missingEntry{obj: obj})
+		c.missing[obj] = el
+	}
+	el.Value.(*missingEntry).expires = c.now().Add(c.config.NegativeTTL)
+	c.missingLRU.MoveToFront(el)
+	for c.missingLRU.Len() > c.config.MaxEntries {
+		c.removeMissing(c.missingLRU.Back())
+	}
+}
+
+// removeMissing forgets that an object is missing
+func (c *Cache) removeMissing(el *list.Element) {
+	entry := c.missingLRU.Remove(el).(*missingEntry)
+	delete(c.missing, entry.obj)
+}
+
+// getVariant returns the cached compressed representation of a generation of an
+// object, or nil if it has not been cached
+func (c *Cache) getVariant(obj objectKey, generation int64, encoding string, level int) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[cacheKey{objectKey: obj, generation: generation}]
+	if !ok {
+		return nil
+	}
+	c.touch(el)
+	return el.Value.(*cacheEntry).variants[variantKey{encoding: encoding, level: level}]
+}
+
+// putVariant stores a compressed representation of a generation of an object whose
+// attributes are cached. Like contents, representations larger than MaxObjectSize
+// are not cached.
+func (c *Cache) putVariant(obj objectKey, generation int64, encoding string, level int, data []byte) {
+	if int64(len(data)) > c.config.MaxObjectSize || int64(len(data)) > c.config.MaxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[cacheKey{objectKey: obj, generation: generation}]
+	if !ok {
+		return
+	}
+	entry := el.Value.(*cacheEntry)
+	key := variantKey{encoding: encoding, level: level}
+	if _, ok := entry.variants[key]; ok {
+		return
+	}
+	if entry.variants == nil {
+		entry.variants = make(map[variantKey][]byte)
+	}
+	entry.variants[key] = data
+	c.bytes += int64(len(data))
+	c.touch(el)
+	c.evict()
+}
+
+// touch marks an entry as recently used, unless it is a generation that has been
+// replaced, which stays first in line for eviction
+func (c *Cache) touch(el *list.Element) {
+	entry := el.Value.(*cacheEntry)
+	if c.latest[entry.key.objectKey] == entry.key {
+		c.lru.MoveToFront(el)
+	}
+}
+
+// evict removes the least recently used entries until the cache is within its bounds
+func (c *Cache) evict() {
+	for c.lru.Len() > c.config.MaxEntries || c.bytes > c.config.MaxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove removes an entry from the cache
+func (c *Cache) remove(el *list.Element) {
+	entry := c.lru.Remove(el).(*cacheEntry)
+	delete(c.entries, entry.key)
+	if c.latest[entry.key.objectKey] == entry.key {
+		delete(c.latest, entry.key.objectKey)
+	}
+	c.bytes -= entry.size()
+}
+
+// do calls fetch once for all concurrent callers with the same key and returns its
+// result to each of them. The fetch keeps the deadline of the caller that started
+// it but is not cancelled with it, so a caller that gives up does not fail the
+// others. Each caller still returns as soon as its own context is done.
+func (c *Cache) do(ctx context.Context, key string, fetch func(ctx context.Context) (any, error)) (any, error) {
+	ch := c.group.DoChan(key, func() (any, error) {
+		fetchCtx, cancel := detachContext(ctx)
+		defer cancel()
+		return fetch(fetchCtx)
+	})
+	select {
+	case res := <-ch:
+		return res.Val, res.Err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// detachContext returns a context with the values and deadline of ctx that is
+// not cancelled when ctx is
+func detachContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	detached := context.WithoutCancel(ctx)
+	if deadline, ok := ctx.Deadline(); ok {
+		return context.WithDeadline(detached, deadline)
+	}
+	return detached, func() {}
+}
+
+// flightKey returns the key under which fetches of an object are coalesced
+func (k cacheKey) flightKey(op string) string {
+	return op + "\x00" + k.bucket + "\x00" + k.name + "\x00" + strconv.FormatInt(k.generation, 10)
+}
+
+// cachedBackend is a Backend that answers Stat, Open and OpenRange from a Cache
+// and only goes to the wrapped Backend for objects that are not cached. Contents
+// are read by generation, so they always match the attributes they were served with.
+// Concurrent misses on the same object share a single request to the backend,
+// and expired objects are served stale as allowed by the CacheConfig.
+type cachedBackend struct {
+	Backend
+	cache  *Cache
+	bucket string
+}
+
+// newCachedBackend returns backend wrapped by cache. The bucket name keeps apart
+// the objects of different backends sharing the cache.
+func newCachedBackend(cache *Cache, bucket string, backend Backend) cachedBackend {
+	return cachedBackend{
+		Backend: backend,
+		cache:   cache,
+		bucket:  bucket,
+	}
+}
+
+// key returns the key of the named object
+func (b cachedBackend) key(name string) objectKey {
+	return objectKey{bucket: b.bucket, name: name}
+}
+
+// Stat returns the cached attributes of the object, retrieving and caching them on a miss
+func (b cachedBackend) Stat(ctx context.Context, name string) (*ObjectAttrs, error) {
+	attrs, _, err := b.StatStale(ctx, name)
+	return attrs, err
+}
+
+// StatStale is like Stat, but also reports whether the attributes are stale.
+// Within StaleWhileRevalidate after their TTL, expired attributes are returned
+// right away and retrieved again in the background. Within StaleIfError, they
+// are returned when retrieving them again fails for any reason but the object
+// no longer existing. Attributes are only served stale along with a cached content,
+// since a replaced generation may no longer be readable from the backend. Objects
+// remembered as missing are reported as such without going to the backend.
+func (b cachedBackend) StatStale(ctx context.Context, name string) (*ObjectAttrs, bool, error) {
+	if b.cache.isMissing(b.key(name)) {
+		b.cache.hits.Add(1)
+		return nil, false, ErrObjectNotExist
+	}
+	cached, body, age, ok := b.cache.lookup(b.key(name))
+	if ok && age <= 0 {
+		b.cache.hits.Add(1)
+		return cached, false, nil
+	}
+	servable := ok && body != nil
+	if servable && age <= b.cache.config.StaleWhileRevalidate {
+		b.cache.hits.Add(1)
+		b.cache.stale.Add(1)
+		go func() {
+			ctx, cancel := detachContext(ctx)
+			defer cancel()
+			b.fetchAttrs(ctx, name)
+		}()
+		return cached, true, nil
+	}
+	b.cache.misses.Add(1)
+
+	attrs, err := b.fetchAttrs(ctx, name)
+	if err != nil && !isNotExist(err) && servable && age <= b.cache.config.StaleIfError {
+		b.cache.stale.Add(1)
+		return cached, true, nil
+	}
+	return attrs, false, err
+}
+
+// fetchAttrs retrieves the attributes of the object from the backend and caches them
+func (b cachedBackend) fetchAttrs(ctx context.Context, name string) (*ObjectAttrs, error) {
+	key := cacheKey{objectKey: b.key(name)}
+	v, err := b.cache.do(ctx, key.flightKey("stat"), func(ctx context.Context) (any, error) {
+		attrs, err := b.Backend.Stat(ctx, name)
+		if isNotExist(err) {
+			b.cache.putMissing(key.objectKey)
+		}
+		if err != nil {
+			return nil, err
+		}
+		b.cache.putAttrs(key.objectKey, attrs)
+		return attrs, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Every caller gets its own copy of the shared attributes
+	attrs := *v.(*ObjectAttrs)
+	return &attrs, nil
+}
+
+// Open returns a reader of the cached content of the latest generation of the
+// object. The content of an expired object is still used while its attributes may
+// be served stale, so that it matches the attributes returned by StatStale.
+func (b cachedBackend) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	attrs, _, ok := b.cache.getStale(b.key(name), b.cache.maxStale())
+	if !ok {
+		b.cache.misses.Add(1)
+		return b.Backend.Open(ctx, name)
+	}
+	return b.OpenGeneration(ctx, name, attrs.Generation)
+}
+
+// OpenGeneration returns a reader of the cached content of a generation of the
+// object. On a miss the generation is read from the backend and, if its attributes
+// are cached and it is not larger than MaxObjectSize, its content is cached.
+// Generations that are not cached are streamed from the backend to each caller
+// separately. A generation the backend no longer has is dropped from the cache, so
+// that the attributes of the object are retrieved again.
+func (b cachedBackend) OpenGeneration(ctx context.Context, name string, generation int64) (io.ReadCloser, error) {
+	key := cacheKey{objectKey: b.key(name), generation: generation}
+	attrs, body, ok := b.cache.getGeneration(key)
+	if body != nil {
+		b.cache.hits.Add(1)
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	b.cache.misses.Add(1)
+
+	if !ok || attrs.Size > b.cache.config.MaxObjectSize {
+		reader, err := openGeneration(ctx, b.Backend, name, generation)
+		return reader, b.forgetReplaced(key, err)
+	}
+
+	v, err := b.cache.do(ctx, key.flightKey("open"), func(ctx context.Context) (any, error) {
+		reader, err := openGeneration(ctx, b.Backend, name, generation)
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+
+		body, err := io.ReadAll(reader)
+		if err != nil {
+			return nil, err
+		}
+		// A different size means the backend read a newer generation than the one
+		// whose attributes were retrieved
+		if int64(len(body)) == attrs.Size {
+			b.cache.putBody(key.objectKey, key.generation, body)
+		}
+		return body, nil
+	})
+	if err != nil {
+		return nil, b.forgetReplaced(key, err)
+	}
+	return io.NopCloser(bytes.NewReader(v.([]byte))), nil
+}
+
+// forgetReplaced drops a cached generation of an object if err reports that the
+// backend no longer has it, and returns err
+func (b cachedBackend) forgetReplaced(key cacheKey, err error) error {
+	if errors.Is(err, errGenerationReplaced) {
+		b.cache.removeGeneration(key)
+	}
+	return err
+}
+
+// OpenRange returns a reader of a range of the cached content of the latest
+// generation of the object, or reads the range from the backend if the object is
+// not cached
+func (b cachedBackend) OpenRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	attrs, _, ok := b.cache.getStale(b.key(name), b.cache.maxStale())
+	if !ok {
+		b.cache.misses.Add(1)
+		return openRange(ctx, b.Backend, name, offset, length)
+	}
+	return b.OpenRangeGeneration(ctx, name, attrs.Generation, offset, length)
+}
+
+// OpenRangeGeneration returns a reader of a range of the cached content of a
+// generation of the object, or reads the range from the backend if the content
+// is not cached. Like OpenGeneration, it drops a generation the backend no longer has.
+func (b cachedBackend) OpenRangeGeneration(ctx context.Context, name string, generation, offset, length int64) (io.ReadCloser, error) {
+	key := cacheKey{objectKey: b.key(name), generation: generation}
+	if _, body, _ := b.cache.getGeneration(key); body != nil && offset+length <= int64(len(body)) {
+		b.cache.hits.Add(1)
+		return io.NopCloser(bytes.NewReader(body[offset : offset+length])), nil
+	}
+	b.cache.misses.Add(1)
+	reader, err := openRangeGeneration(ctx, b.Backend, name, generation, offset, length)
+	return reader, b.forgetReplaced(key, err)
+}
@@ -0,0 +1,733 @@
+package gcsmiddleware
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestCache tests the bounds and generation handling of the cache
+func TestCache(t *testing.T) {
+	obj := func(name string) objectKey {
+		return objectKey{bucket: "bucket", name: name}
+	}
+
+	t.Run("Attributes and content", func(t *testing.T) {
+		cache := NewCache(CacheConfig{})
+		_, _, ok := cache.get(obj("a"))
+		assert.False(t, ok)
+
+		cache.putAttrs(obj("a"), &ObjectAttrs{Name: "a", Size: 3, Generation: 1})
+		attrs, body, ok := cache.get(obj("a"))
+		assert.True(t, ok)
+		assert.Equal(t, int64(1), attrs.Generation)
+		assert.Nil(t, body)
+
+		cache.putBody(obj("a"), 1, []byte("abc"))
+		_, body, _ = cache.get(obj("a"))
+		assert.Equal(t, []byte("abc"), body)
+		assert.Equal(t, CacheStats{Entries: 1, Bytes: 3}, cache.Stats())
+
+		// Buckets are kept apart
+		_, _, ok = cache.get(objectKey{bucket: "other", name: "a"})
+		assert.False(t, ok)
+	})
+
+	t.Run("Generations", func(t *testing.T) {
+		cache := NewCache(CacheConfig{MaxEntries: 2})
+		cache.putAttrs(obj("a"), &ObjectAttrs{Generation: 1})
+		cache.putBody(obj("a"), 1, []byte("abc"))
+
+		// The same generation keeps its content
+		cache.putAttrs(obj("a"), &ObjectAttrs{Generation: 1})
+		_, body, _ := cache.get(obj("a"))
+		assert.Equal(t, []byte("abc"), body)
+
+		// A new generation does not inherit the old content
+		cache.putAttrs(obj("a"), &ObjectAttrs{Generation: 2})
+		_, body, _ = cache.get(obj("a"))
+		assert.Nil(t, body)
+
+		// The old content is kept for requests still answered with it
+		_, body, ok := cache.getGeneration(cacheKey{objectKey: obj("a"), generation: 1})
+		assert.True(t, ok)
+		assert.Equal(t, []byte("abc"), body)
+		assert.Equal(t, CacheStats{Entries: 2, Bytes: 3}, cache.Stats())
+
+		// but is the first to be evicted
+		cache.putAttrs(obj("b"), &ObjectAttrs{Generation: 1})
+		_, _, ok = cache.getGeneration(cacheKey{objectKey: obj("a"), generation: 1})
+		assert.False(t, ok)
+		_, _, ok = cache.get(obj("a"))
+		assert.True(t, ok)
+		assert.Equal(t, CacheStats{Entries: 2}, cache.Stats())
+	})
+
+	t.Run("TTL", func(t *testing.T) {
+		now := time.Now()
+		cache := NewCache(CacheConfig{TTL: time.Minute})
+		cache.now = func() time.Time { return now }
+		cache.putAttrs(obj("a"), &ObjectAttrs{Generation: 1})
+
+		now = now.Add(59 * time.Second)
+		_, _, ok := cache.get(obj("a"))
+		assert.True(t, ok)
+
+		now = now.Add(2 * time.Second)
+		_, _, ok = cache.get(obj("a"))
+		assert.False(t, ok)
+	})
+
+	t.Run("MaxEntries", func(t *testing.T) {
+		cache := NewCache(CacheConfig{MaxEntries: 2})
+		cache.putAttrs(obj("a"), &ObjectAttrs{})
+		cache.putAttrs(obj("b"), &ObjectAttrs{})
+		cache.get(obj("a"))
+		cache.putAttrs(obj("c"), &ObjectAttrs{})
+
+		// b is the least recently used entry
+		_, _, ok := cache.get(obj("b"))
+		assert.False(t, ok)
+		_, _, ok = cache.get(obj("a"))
+		assert.True(t, ok)
+		_, _, ok = cache.get(obj("c"))
+		assert.True(t, ok)
+		assert.Equal(t, 2, cache.Stats().Entries)
+	})
+
+	t.Run("MaxBytes", func(t *testing.T) {
+		cache := NewCache(CacheConfig{MaxBytes: 8})
+		for _, name := range []string{"a", "b", "c"} {
+			cache.putAttrs(obj(name), &ObjectAttrs{})
+			cache.putBody(obj(name), 0, []byte("1234"))
+		}
+		_, _, ok := cache.get(obj("a"))
+		assert.False(t, ok)
+		assert.Equal(t, CacheStats{Entries: 2, Bytes: 8}, cache.Stats())
+
+		// Content larger than the whole cache is never stored
+		cache.putAttrs(obj("d"), &ObjectAttrs{})
+		cache.putBody(obj("d"), 0, []byte("123456789"))
+		_, body, ok := cache.get(obj("d"))
+		assert.True(t, ok)
+		assert.Nil(t, body)
+	})
+
+	t.Run("Compressed representations", func(t *testing.T) {
+		cache := NewCache(CacheConfig{MaxObjectSize: 4})
+		cache.putAttrs(obj("a"), &ObjectAttrs{Generation: 1})
+		cache.putBody(obj("a"), 1, []byte("abcd"))
+		assert.Nil(t, cache.getVariant(obj("a"), 1, "gzip", 6))
+
+		cache.putVariant(obj("a"), 1, "gzip", 6, []byte("gz"))
+		assert.Equal(t, []byte("gz"), cache.getVariant(obj("a"), 1, "gzip", 6))
+		assert.Nil(t, cache.getVariant(obj("a"), 1, "gzip", 9))
+		assert.Nil(t, cache.getVariant(obj("a"), 2, "gzip", 6))
+		assert.Equal(t, CacheStats{Entries: 1, Bytes: 6}, cache.Stats())
+
+		// Representations larger than MaxObjectSize are not cached
+		cache.putVariant(obj("a"), 1, "gzip", 9, []byte("12345"))
+		assert.Nil(t, cache.getVariant(obj("a"), 1, "gzip", 9))
+
+		// A new generation does not inherit the representations of the old one
+		cache.putAttrs(obj("a"), &ObjectAttrs{Generation: 2})
+		assert.Nil(t, cache.getVariant(obj("a"), 2, "gzip", 6))
+		assert.Equal(t, []byte("gz"), cache.getVariant(obj("a"), 1, "gzip", 6))
+	})
+
+	t.Run("Missing objects", func(t *testing.T) {
+		now := time.Now()
+		cache := NewCache(CacheConfig{NegativeTTL: 10 * time.Second, MaxEntries: 2})
+		cache.now = func() time.Time { return now }
+		cache.putAttrs(obj("a"), &ObjectAttrs{Generation: 1})
+
+		// A missing object replaces its cached generations
+		cache.putMissing(obj("a"))
+		assert.True(t, cache.isMissing(obj("a")))
+		_, _, ok := cache.get(obj("a"))
+		assert.False(t, ok)
+		assert.Equal(t, CacheStats{MissingEntries: 1}, cache.Stats())
+
+		// Missing objects are bounded separately from cached objects
+		cache.putAttrs(obj("b"), &ObjectAttrs{})
+		cache.putAttrs(obj("c"), &ObjectAttrs{})
+		cache.putMissing(obj("d"))
+		cache.putMissing(obj("e"))
+		assert.False(t, cache.isMissing(obj("a")))
+		assert.Equal(t, CacheStats{Entries: 2, MissingEntries: 2}, cache.Stats())
+
+		// An object that appears is no longer missing
+		cache.putAttrs(obj("d"), &ObjectAttrs{})
+		assert.False(t, cache.isMissing(obj("d")))
+
+		now = now.Add(11 * time.Second)
+		assert.False(t, cache.isMissing(obj("e")))
+		assert.Equal(t, 0, cache.Stats().MissingEntries)
+
+		// Without NegativeTTL missing objects are only dropped
+		cache = NewCache(CacheConfig{})
+		cache.putAttrs(obj("a"), &ObjectAttrs{})
+		cache.putMissing(obj("a"))
+		assert.False(t, cache.isMissing(obj("a")))
+		assert.Equal(t, CacheStats{}, cache.Stats())
+	})
+}
+
+// TestServerHeaderCache tests that cached files are served without going to the backend
+func TestServerHeaderCache(t *testing.T) {
+	body := strings.Repeat("Hello, World!", 100)
+	backend := &countingBackend{
+		Backend: memoryBackend{
+			"app.js":    []byte(body),
+			"video.mp4": []byte(body + body),
+		},
+	}
+	cache := NewCache(CacheConfig{MaxObjectSize: int64(len(body))})
+	config := GCSStaticConfig{
+		Backend:  backend,
+		RootPath: "/",
+		Cache:    cache,
+	}
+
+	for i := 0; i < 3; i++ {
+		rec := serve(config, httptest.NewRequest(http.MethodGet, "/app.js", nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, body, rec.Body.String())
+	}
+	assert.Equal(t, int32(1), backend.stats.Load())
+	assert.Equal(t, int32(1), backend.opens.Load())
+	assert.Equal(t, CacheStats{Hits: 4, Misses: 2, Entries: 1, Bytes: int64(len(body))}, cache.Stats())
+
+	// Ranges are served from the cached content
+	req := httptest.NewRequest(http.MethodGet, "/app.js", nil)
+	req.Header.Set("Range", "bytes=0-4")
+	rec := serve(config, req)
+	assert.Equal(t, http.StatusPartialContent, rec.Code)
+	assert.Equal(t, "Hello", rec.Body.String())
+	assert.Equal(t, int32(1), backend.opens.Load())
+
+	// Objects above MaxObjectSize are read from the backend every time
+	for i := 0; i < 2; i++ {
+		rec := serve(config, httptest.NewRequest(http.MethodGet, "/video.mp4", nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, body+body, rec.Body.String())
+	}
+	assert.Equal(t, int32(2), backend.stats.Load())
+	assert.Equal(t, int32(3), backend.opens.Load())
+}
+
+// TestServerHeaderCacheConcurrent tests serving cached files from many goroutines
+func TestServerHeaderCacheConcurrent(t *testing.T) {
+	backend := memoryBackend{
+		"index.html": []byte("<html>app</html>"),
+		"main.js":    []byte("console.log(1)"),
+	}
+	cache := NewCache(CacheConfig{MaxEntries: 1})
+	config := GCSStaticConfig{
+		Backend:  backend,
+		RootPath: "/",
+		IsSPA:    true,
+		Cache:    cache,
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		target, want := "/main.js", "console.log(1)"
+		if i%2 == 0 {
+			target, want = "/dashboard", "<html>app</html>"
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := serve(config, httptest.NewRequest(http.MethodGet, target, nil))
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, want, rec.Body.String())
+		}()
+	}
+	wg.Wait()
+	assert.LessOrEqual(t, cache.Stats().Entries, 1)
+}
+
+// heldBackend is a countingBackend whose calls are held until release is closed
+type heldBackend struct {
+	countingBackend
+	release chan struct{}
+}
+
+func (b *heldBackend) Stat(ctx context.Context, name string) (*ObjectAttrs, error) {
+	<-b.release
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return b.countingBackend.Stat(ctx, name)
+}
+
+func (b *heldBackend) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	<-b.release
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return b.countingBackend.Open(ctx, name)
+}
+
+// TestCacheCoalescing tests that concurrent misses on the same object share one backend request
+func TestCacheCoalescing(t *testing.T) {
+	const waiters = 20
+	newBackend := func() (*heldBackend, cachedBackend, *Cache) {
+		backend := &heldBackend{
+			countingBackend: countingBackend{Backend: memoryBackend{"main.js": []byte("console.log(1)")}},
+			release:         make(chan struct{}),
+		}
+		cache := NewCache(CacheConfig{})
+		return backend, newCachedBackend(cache, "bucket", backend), cache
+	}
+	// waitForMisses waits until every waiter has missed the cache and joined the fetch
+	waitForMisses := func(cache *Cache, misses int64) {
+		assert.Eventually(t, func() bool { return cache.Stats().Misses == misses }, time.Second, time.Millisecond)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Run("Stat and Open", func(t *testing.T) {
+		backend, cached, cache := newBackend()
+
+		var wg sync.WaitGroup
+		for i := 0; i < waiters; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				attrs, err := cached.Stat(context.Background(), "main.js")
+				if assert.NoError(t, err) {
+					assert.Equal(t, int64(14), attrs.Size)
+				}
+			}()
+		}
+		waitForMisses(cache, waiters)
+		close(backend.release)
+		wg.Wait()
+		assert.Equal(t, int32(1), backend.stats.Load())
+
+		// Only the attributes are cached, so the contents are read once for all waiters
+		backend.release = make(chan struct{})
+		for i := 0; i < waiters; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				reader, err := cached.Open(context.Background(), "main.js")
+				if assert.NoError(t, err) {
+					defer reader.Close()
+					body, _ := io.ReadAll(reader)
+					assert.Equal(t, "console.log(1)", string(body))
+				}
+			}()
+		}
+		waitForMisses(cache, 2*waiters)
+		close(backend.release)
+		wg.Wait()
+		assert.Equal(t, int32(1), backend.opens.Load())
+	})
+
+	t.Run("Cancelled waiter", func(t *testing.T) {
+		backend, cached, cache := newBackend()
+
+		// The first waiter starts the fetch and gives up before it completes
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() {
+			_, err := cached.Stat(ctx, "main.js")
+			done <- err
+		}()
+		waitForMisses(cache, 1)
+
+		var wg sync.WaitGroup
+		for i := 0; i < waiters; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := cached.Stat(context.Background(), "main.js")
+				assert.NoError(t, err)
+			}()
+		}
+		waitForMisses(cache, waiters+1)
+
+		cancel()
+		assert.ErrorIs(t, <-done, context.Canceled)
+		close(backend.release)
+		wg.Wait()
+		assert.Equal(t, int32(1), backend.stats.Load())
+	})
+}
+
+// TestServerHeaderCacheStale tests serving expired files while they are revalidated
+// and while the backend fails
+func TestServerHeaderCacheStale(t *testing.T) {
+	body := "console.log(1)"
+	errs := map[string]error{}
+	backend := &countingBackend{
+		Backend: failingBackend{memoryBackend: memoryBackend{"app.js": []byte(body)}, errs: errs},
+	}
+	now := time.Now()
+	cache := NewCache(CacheConfig{
+		TTL:                  time.Minute,
+		StaleWhileRevalidate: time.Minute,
+		StaleIfError:         10 * time.Minute,
+	})
+	cache.now = func() time.Time { return now }
+	config := GCSStaticConfig{
+		Backend:  backend,
+		RootPath: "/",
+		Cache:    cache,
+	}
+	get := func() *httptest.ResponseRecorder {
+		return serve(config, httptest.NewRequest(http.MethodGet, "/app.js", nil))
+	}
+	obj := objectKey{name: "app.js"}
+
+	rec := get()
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, rec.Header().Get("X-Cache"))
+
+	// An expired file is served right away and revalidated in the background
+	now = now.Add(90 * time.Second)
+	rec = get()
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, body, rec.Body.String())
+	assert.Equal(t, "STALE", rec.Header().Get("X-Cache"))
+	assert.Equal(t, staleWarning, rec.Header().Get("Warning"))
+	assert.Eventually(t, func() bool {
+		_, _, ok := cache.get(obj)
+		return ok
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, int32(2), backend.stats.Load())
+
+	rec = get()
+	assert.Empty(t, rec.Header().Get("X-Cache"))
+	assert.Equal(t, int32(2), backend.stats.Load())
+
+	// Past StaleWhileRevalidate the file is revalidated before it is served,
+	// and served stale if that fails
+	errs["app.js"] = ErrTimeout
+	now = now.Add(3 * time.Minute)
+	rec = get()
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, body, rec.Body.String())
+	assert.Equal(t, "STALE", rec.Header().Get("X-Cache"))
+	assert.Equal(t, int32(3), backend.stats.Load())
+	assert.Equal(t, int32(1), backend.opens.Load())
+
+	// Past StaleIfError the failure is reported
+	now = now.Add(10 * time.Minute)
+	rec = get()
+	assert.Equal(t, http.StatusGatewayTimeout, rec.Code)
+
+	// A file that no longer exists is never served stale
+	delete(errs, "app.js")
+	rec = get()
+	assert.Equal(t, http.StatusOK, rec.Code)
+	errs["app.js"] = ErrObjectNotExist
+	now = now.Add(3 * time.Minute)
+	rec = get()
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	_, _, ok := cache.getStale(obj, time.Hour)
+	assert.False(t, ok)
+	assert.Equal(t, int64(2), cache.Stats().Stale)
+}
+
+// TestServerHeaderCacheMissing tests that missing files are not looked up again
+// until NegativeTTL has passed
+func TestServerHeaderCacheMissing(t *testing.T) {
+	backend := &countingBackend{
+		Backend: memoryBackend{"index.html": []byte("<html>app</html>")},
+	}
+	now := time.Now()
+	cache := NewCache(CacheConfig{NegativeTTL: 10 * time.Second})
+	cache.now = func() time.Time { return now }
+	config := GCSStaticConfig{
+		Backend:  backend,
+		RootPath: "/",
+		IsSPA:    true,
+		Cache:    cache,
+	}
+
+	for i := 0; i < 3; i++ {
+		rec := serve(config, httptest.NewRequest(http.MethodGet, "/dashboard", nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "<html>app</html>", rec.Body.String())
+	}
+	// One lookup of dashboard/index.html and one of index.html
+	assert.Equal(t, int32(2), backend.stats.Load())
+	assert.Equal(t, 1, cache.Stats().MissingEntries)
+
+	// A file deployed meanwhile is picked up once NegativeTTL has passed
+	backend.Backend.(memoryBackend)["dashboard/index.html"] = []byte("<html>dashboard</html>")
+	rec := serve(config, httptest.NewRequest(http.MethodGet, "/dashboard", nil))
+	assert.Equal(t, "<html>app</html>", rec.Body.String())
+
+	now = now.Add(11 * time.Second)
+	rec = serve(config, httptest.NewRequest(http.MethodGet, "/dashboard", nil))
+	assert.Equal(t, "<html>dashboard</html>", rec.Body.String())
+	assert.Equal(t, 0, cache.Stats().MissingEntries)
+}
+
+// TestServerHeaderCacheCompressed tests that compressed files are compressed once
+// and then served from the cache
+func TestServerHeaderCacheCompressed(t *testing.T) {
+	body := strings.Repeat("Hello, World!", 100)
+	backend := &countingBackend{
+		Backend: attrsBackend{
+			memoryBackend: memoryBackend{"app.js": []byte(body)},
+			attrs:         ObjectAttrs{Generation: 1, MD5: []byte{0x01, 0x02, 0x03}},
+		},
+	}
+	cache := NewCache(CacheConfig{})
+	config := GCSStaticConfig{
+		Backend:           backend,
+		BucketName:        "bucket",
+		RootPath:          "/",
+		EnableCompression: true,
+		Cache:             cache,
+	}
+	get := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/app.js", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		return serve(config, req)
+	}
+
+	head := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodHead, "/app.js", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		return serve(config, req)
+	}
+
+	// The compressed length is not known before the file has been compressed
+	rec := head()
+	assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	assert.Empty(t, rec.Header().Get("Content-Length"))
+
+	first := get()
+	assert.Equal(t, http.StatusOK, first.Code)
+	assert.Equal(t, "gzip", first.Header().Get("Content-Encoding"))
+
+	// Once the compressed representation is cached, HEAD sends its length
+	rec = head()
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, first.Header().Get("Content-Length"), rec.Header().Get("Content-Length"))
+	assert.Empty(t, rec.Body.String())
+	compressed := cache.getVariant(objectKey{bucket: "bucket", name: "app.js"}, 1, "gzip", 6)
+	assert.Equal(t, first.Body.Bytes(), compressed)
+	assert.Equal(t, int64(len(body)+len(compressed)), cache.Stats().Bytes)
+
+	for i := 0; i < 3; i++ {
+		rec := get()
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+		assert.Equal(t, first.Header().Get("Content-Length"), rec.Header().Get("Content-Length"))
+		assert.Equal(t, first.Header().Get("ETag"), rec.Header().Get("ETag"))
+		assert.Equal(t, first.Body.Bytes(), rec.Body.Bytes())
+	}
+	assert.Equal(t, int32(1), backend.opens.Load())
+
+	// A different level is a different representation
+	config.CompressionLevel = 9
+	rec = get()
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NotNil(t, cache.getVariant(objectKey{bucket: "bucket", name: "app.js"}, 1, "gzip", 9))
+}
+
+// versionedBackend is a Backend that keeps every generation of its objects, like
+// a GCS bucket with object versioning. Generations are numbered from 1. With
+// latestOnly set, only the latest generation can be read, like a bucket without
+// object versioning.
+type versionedBackend struct {
+	mu         sync.Mutex
+	versions   map[string][][]byte
+	latestOnly bool
+}
+
+// put stores a new generation of the named object
+func (b *versionedBackend) put(name, data string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.versions[name] = append(b.versions[name], []byte(data))
+}
+
+// get returns the given generation of the named object, or the latest one if
+// generation is zero
+func (b *versionedBackend) get(name string, generation int64) (int64, []byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	versions := b.versions[name]
+	if generation == 0 {
+		generation = int64(len(versions))
+	}
+	if generation < 1 || generation > int64(len(versions)) || b.latestOnly && generation != int64(len(versions)) {
+		return 0, nil, ErrObjectNotExist
+	}
+	return generation, versions[generation-1], nil
+}
+
+func (b *versionedBackend) Stat(_ context.Context, name string) (*ObjectAttrs, error) {
+	generation, data, err := b.get(name, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectAttrs{Name: name, Size: int64(len(data)), Generation: generation}, nil
+}
+
+func (b *versionedBackend) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	return b.OpenGeneration(ctx, name, 0)
+}
+
+func (b *versionedBackend) OpenGeneration(_ context.Context, name string, generation int64) (io.ReadCloser, error) {
+	_, data, err := b.get(name, generation)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (b *versionedBackend) OpenRangeGeneration(_ context.Context, name string, generation, offset, length int64) (io.ReadCloser, error) {
+	_, data, err := b.get(name, generation)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data[offset : offset+length])), nil
+}
+
+func (b *versionedBackend) List(context.Context, string) ([]*ObjectAttrs, error) {
+	return nil, nil
+}
+
+// TestServerHeaderCacheGenerations tests that a file replaced while its attributes
+// are cached is served with the content of the cached generation
+func TestServerHeaderCacheGenerations(t *testing.T) {
+	backend := &versionedBackend{versions: map[string][][]byte{}}
+	backend.put("video.mp4", "0123456789")
+	config := GCSStaticConfig{
+		Backend:  backend,
+		RootPath: "/",
+		Cache:    NewCache(CacheConfig{MaxObjectSize: 4}),
+	}
+
+	rec := serve(config, httptest.NewRequest(http.MethodGet, "/video.mp4", nil))
+	assert.Equal(t, "0123456789", rec.Body.String())
+
+	// The content is too large to be cached, so only the attributes are
+	backend.put("video.mp4", "abcdefghijklmnopqrstuvwxyz")
+	rec = serve(config, httptest.NewRequest(http.MethodGet, "/video.mp4", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "10", rec.Header().Get("Content-Length"))
+	assert.Equal(t, "0123456789", rec.Body.String())
+
+	req := httptest.NewRequest(http.MethodGet, "/video.mp4", nil)
+	req.Header.Set("Range", "bytes=2-4")
+	rec = serve(config, req)
+	assert.Equal(t, http.StatusPartialContent, rec.Code)
+	assert.Equal(t, "bytes 2-4/10", rec.Header().Get("Content-Range"))
+	assert.Equal(t, "234", rec.Body.String())
+}
+
+// TestServerHeaderCacheStaleReplaced tests that a file replaced while it is served
+// stale is answered with the content of the generation its headers describe
+func TestServerHeaderCacheStaleReplaced(t *testing.T) {
+	backend := &versionedBackend{versions: map[string][][]byte{}, latestOnly: true}
+	backend.put("app.js", "console.log(1)")
+	backend.put("video.mp4", "0123456789abcdefghij")
+	now := time.Now()
+	cache := NewCache(CacheConfig{
+		MaxObjectSize:        int64(len("console.log(1)")),
+		TTL:                  time.Minute,
+		StaleWhileRevalidate: time.Minute,
+	})
+	cache.now = func() time.Time { return now }
+	cached := newCachedBackend(cache, "", backend)
+	config := GCSStaticConfig{
+		Backend:  backend,
+		RootPath: "/",
+		Cache:    cache,
+	}
+	for _, target := range []string{"/app.js", "/video.mp4"} {
+		rec := serve(config, httptest.NewRequest(http.MethodGet, target, nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+	}
+
+	// The stale generation stays readable after the revalidation replaced it
+	now = now.Add(90 * time.Second)
+	backend.put("app.js", "console.log(22)")
+	attrs, stale, err := cached.StatStale(context.Background(), "app.js")
+	assert.NoError(t, err)
+	assert.True(t, stale)
+	assert.Eventually(t, func() bool {
+		attrs, _, ok := cache.get(objectKey{name: "app.js"})
+		return ok && attrs.Generation == 2
+	}, time.Second, time.Millisecond)
+	reader, err := cached.OpenGeneration(context.Background(), "app.js", attrs.Generation)
+	if assert.NoError(t, err) {
+		body, _ := io.ReadAll(reader)
+		assert.Equal(t, "console.log(1)", string(body))
+	}
+
+	// A file whose content is not cached is revalidated before it is served
+	backend.put("video.mp4", "abcdefghijklmnopqrstuvwxyz")
+	rec := serve(config, httptest.NewRequest(http.MethodGet, "/video.mp4", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, rec.Header().Get("X-Cache"))
+	assert.Equal(t, "26", rec.Header().Get("Content-Length"))
+	assert.Equal(t, "abcdefghijklmnopqrstuvwxyz", rec.Body.String())
+}
+
+// TestServerHeaderCacheReplacedGeneration tests that a file replaced in a bucket
+// without object versioning is served again as soon as its cached generation
+// turns out to be gone, rather than reported as missing
+func TestServerHeaderCacheReplacedGeneration(t *testing.T) {
+	backend := &versionedBackend{versions: map[string][][]byte{}, latestOnly: true}
+	backend.put("video.mp4", "0123456789abcdefghij")
+	backend.put("app.js", "console.log(1)")
+	cache := NewCache(CacheConfig{MaxObjectSize: 16})
+	config := GCSStaticConfig{
+		Backend:  backend,
+		RootPath: "/",
+		Cache:    cache,
+	}
+
+	// video.mp4 is too large for its content to be cached, and app.js has only
+	// been looked up by a HEAD request so far
+	rec := serve(config, httptest.NewRequest(http.MethodGet, "/video.mp4", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = serve(config, httptest.NewRequest(http.MethodHead, "/app.js", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	backend.put("video.mp4", "abcdefghijklmnopqrstuvwxyz")
+	backend.put("app.js", "console.log(22)")
+	tests := []struct {
+		target     string
+		wantStatus int
+		wantBody   string
+	}{
+		{target: "/video.mp4", wantStatus: http.StatusOK, wantBody: "abcdefghijklmnopqrstuvwxyz"},
+		{target: "/app.js", wantStatus: http.StatusOK, wantBody: "console.log(22)"},
+	}
+	for _, tt := range tests {
+		rec := serve(config, httptest.NewRequest(http.MethodGet, tt.target, nil))
+		assert.Equal(t, tt.wantStatus, rec.Code, tt.target)
+		assert.Equal(t, strconv.Itoa(len(tt.wantBody)), rec.Header().Get("Content-Length"), tt.target)
+		assert.Equal(t, tt.wantBody, rec.Body.String(), tt.target)
+	}
+
+	// A range of a replaced generation is read from the new one
+	backend.put("video.mp4", "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123")
+	req := httptest.NewRequest(http.MethodGet, "/video.mp4", nil)
+	req.Header.Set("Range", "bytes=0-2")
+	rec = serve(config, req)
+	assert.Equal(t, http.StatusPartialContent, rec.Code)
+	assert.Equal(t, "bytes 0-2/30", rec.Header().Get("Content-Range"))
+	assert.Equal(t, "ABC", rec.Body.String())
+}
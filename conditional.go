@@ -0,0 +1,231 @@
+package gcsmiddleware
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// entityTag returns the strong ETag of an object sent with the given content encoding,
+// or "" if the backend reported nothing to derive one from.
+//
+// The MD5 hash identifies the content itself, so re-uploading the same bytes keeps the
+// ETag. Composite objects have no MD5 and fall back to the generation and CRC32C checksum,
+// and finally to the backend's own Etag. A compressed representation has different bytes,
+// so the encoding is appended to keep the tag strong.
+func entityTag(attrs *ObjectAttrs, encoding string) string {
+	if attrs == nil {
+		return ""
+	}
+	var tag string
+	switch {
+	case len(attrs.MD5) > 0:
+		tag = hex.EncodeToString(attrs.MD5)
+	case attrs.Generation != 0:
+		tag = fmt.Sprintf("%x-%08x", attrs.Generation, attrs.CRC32C)
+	case attrs.Etag != "":
+		tag = strings.Trim(strings.TrimPrefix(attrs.Etag, "W/"), `"`)
+	default:
+		return ""
+	}
+	if encoding != "" {
+		tag += "-" + encoding
+	}
+	return `"` + tag + `"`
+}
+
+// scanETag determines if a syntactically valid ETag is present at s. If so,
+// the ETag and remaining text after consuming the ETag is returned.
+// Otherwise it returns "", "".
+func scanETag(s string) (etag string, remain string) {
+	s = strings.TrimLeft(s, " \t")
+	start := 0
+	if strings.HasPrefix(s, "W/") {
+		start = 2
+	}
+	if len(s[start:]) < 2 || s[start] != '"' {
+		return "", ""
+	}
+	// ETag is either W/"text" or "text".
+	// See RFC 9110 Section 8.8.3.
+	for i := start + 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		// Character values allowed in ETags.
+		case c == 0x21 || c >= 0x23 && c <= 0x7E || c >= 0x80:
+		case c == '"':
+			return s[:i+1], s[i+1:]
+		default:
+			return "", ""
+		}
+	}
+	return "", ""
+}
+
+// etagStrongMatch reports whether a and b match using strong ETag comparison
+func etagStrongMatch(a, b string) bool {
+	return a == b && a != "" && a[0] == '"'
+}
+
+// etagWeakMatch reports whether a and b match using weak ETag comparison
+func etagWeakMatch(a, b string) bool {
+	return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
+
+// condResult is the result of an HTTP request precondition check.
+// See RFC 9110 Section 13.1.
+type condResult int
+
+const (
+	condNone condResult = iota
+	condTrue
+	condFalse
+)
+
+// checkIfMatch evaluates the If-Match header against the ETag using strong comparison
+func checkIfMatch(req *http.Request, etag string) condResult {
+	im := req.Header.Get("If-Match")
+	if im == "" {
+		return condNone
+	}
+	for {
+		im = textproto.TrimString(im)
+		if len(im) == 0 {
+			break
+		}
+		if im[0] == ',' {
+			im = im[1:]
+			continue
+		}
+		if im[0] == '*' {
+			return condTrue
+		}
+		var candidate string
+		candidate, im = scanETag(im)
+		if candidate == "" {
+			break
+		}
+		if etagStrongMatch(candidate, etag) {
+			return condTrue
+		}
+	}
+	return condFalse
+}
+
+// checkIfUnmodifiedSince evaluates the If-Unmodified-Since header against the modification time
+func checkIfUnmodifiedSince(req *http.Request, modtime time.Time) condResult {
+	ius := req.Header.Get("If-Unmodified-Since")
+	if ius == "" || modtime.IsZero() {
+		return condNone
+	}
+	t, err := http.ParseTime(ius)
+	if err != nil {
+		return condNone
+	}
+	// The Last-Modified header truncates sub-second precision so
+	// the modtime needs to be truncated too.
+	if !modtime.Truncate(time.Second).After(t) {
+		return condTrue
+	}
+	return condFalse
+}
+
+// checkIfNoneMatch evaluates the If-None-Match header against the ETag using weak comparison
+func checkIfNoneMatch(req *http.Request, etag string) condResult {
+	inm := req.Header.Get("If-None-Match")
+	if inm == "" {
+		return condNone
+	}
+	for {
+		inm = textproto.TrimString(inm)
+		if len(inm) == 0 {
+			break
+		}
+		if inm[0] == ',' {
+			inm = inm[1:]
+			continue
+		}
+		if inm[0] == '*' {
+			return condFalse
+		}
+		var candidate string
+		candidate, inm = scanETag(inm)
+		if candidate == "" {
+			break
+		}
+		if etag != "" && etagWeakMatch(candidate, etag) {
+			return condFalse
+		}
+	}
+	return condTrue
+}
+
+// checkIfModifiedSince evaluates the If-Modified-Since header against the modification time.
+// It only applies to GET and HEAD requests.
+func checkIfModifiedSince(req *http.Request, modtime time.Time) condResult {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return condNone
+	}
+	ims := req.Header.Get("If-Modified-Since")
+	if ims == "" || modtime.IsZero() {
+		return condNone
+	}
+	t, err := http.ParseTime(ims)
+	if err != nil {
+		return condNone
+	}
+	// The Last-Modified header truncates sub-second precision so
+	// the modtime needs to be truncated too.
+	if !modtime.Truncate(time.Second).After(t) {
+		return condFalse
+	}
+	return condTrue
+}
+
+// checkPreconditions evaluates the conditional headers of the request against the
+// file, which is known from its attributes alone, in the order given by RFC 9110
+// Section 13.2.2: If-Match, or If-Unmodified-Since in its absence, followed by
+// If-None-Match, or If-Modified-Since in its absence.
+//
+// It reports true if the request has been answered, with 412 Precondition Failed,
+// or with 304 Not Modified for a GET or HEAD request whose cached copy is still current.
+func (s *FilesStore) checkPreconditions(c echo.Context, etag string, modtime time.Time) (bool, error) {
+	req := c.Request()
+
+	ch := checkIfMatch(req, etag)
+	if ch == condNone {
+		ch = checkIfUnmodifiedSince(req, modtime)
+	}
+	if ch == condFalse {
+		return true, c.NoContent(http.StatusPreconditionFailed)
+	}
+
+	switch checkIfNoneMatch(req, etag) {
+	case condFalse:
+		if req.Method == http.MethodGet || req.Method == http.MethodHead {
+			return true, s.notModified(c)
+		}
+		return true, c.NoContent(http.StatusPreconditionFailed)
+	case condNone:
+		if checkIfModifiedSince(req, modtime) == condFalse {
+			return true, s.notModified(c)
+		}
+	}
+	return false, nil
+}
+
+// notModified answers the request with 304 Not Modified. The validators and Vary
+// headers already set are kept, while Last-Modified is dropped when an ETag is
+// present as recommended by RFC 9110 Section 15.4.5.
+func (s *FilesStore) notModified(c echo.Context) error {
+	header := c.Response().Header()
+	if header.Get("ETag") != "" {
+		header.Del("Last-Modified")
+	}
+	return c.NoContent(http.StatusNotModified)
+}
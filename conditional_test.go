@@ -0,0 +1,354 @@
+package gcsmiddleware
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// countingBackend wraps a Backend and counts the calls made to it
+type countingBackend struct {
+	Backend
+	stats atomic.Int32
+	opens atomic.Int32
+}
+
+func (b *countingBackend) Stat(ctx context.Context, name string) (*ObjectAttrs, error) {
+	b.stats.Add(1)
+	return b.Backend.Stat(ctx, name)
+}
+
+func (b *countingBackend) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	b.opens.Add(1)
+	return b.Backend.Open(ctx, name)
+}
+
+// attrsBackend is a memoryBackend that reports fixed attributes for its objects
+type attrsBackend struct {
+	memoryBackend
+	attrs ObjectAttrs
+}
+
+func (b attrsBackend) Stat(ctx context.Context, name string) (*ObjectAttrs, error) {
+	attrs, err := b.memoryBackend.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	result := b.attrs
+	result.Name = attrs.Name
+	result.Size = attrs.Size
+	return &result, nil
+}
+
+// TestEntityTag tests deriving ETags from object attributes
+func TestEntityTag(t *testing.T) {
+	tests := []struct {
+		name     string
+		attrs    *ObjectAttrs
+		encoding string
+		want     string
+	}{
+		{
+			name:  "MD5 hash",
+			attrs: &ObjectAttrs{MD5: []byte{0xde, 0xad, 0xbe, 0xef}, Generation: 5, Etag: "CAU="},
+			want:  `"deadbeef"`,
+		},
+		{
+			name:     "MD5 hash with encoding",
+			attrs:    &ObjectAttrs{MD5: []byte{0xde, 0xad, 0xbe, 0xef}},
+			encoding: "gzip",
+			want:     `"deadbeef-gzip"`,
+		},
+		{
+			name:  "Composite object without MD5",
+			attrs: &ObjectAttrs{Generation: 1700000000, CRC32C: 0xabc},
+			want:  `"6553f100-00000abc"`,
+		},
+		{
+			name:  "Backend Etag only",
+			attrs: &ObjectAttrs{Etag: `W/"v1"`},
+			want:  `"v1"`,
+		},
+		{
+			name:  "No validators",
+			attrs: &ObjectAttrs{Size: 10},
+			want:  "",
+		},
+		{
+			name:  "No attributes",
+			attrs: nil,
+			want:  "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, entityTag(tt.attrs, tt.encoding))
+		})
+	}
+}
+
+// TestCheckIfNoneMatch tests matching If-None-Match headers against an ETag
+func TestCheckIfNoneMatch(t *testing.T) {
+	tests := []struct {
+		header string
+		want   condResult
+	}{
+		{`"abc"`, condFalse},
+		{`W/"abc"`, condFalse},
+		{`"xyz", "abc"`, condFalse},
+		{`"xyz","abc"`, condFalse},
+		{`*`, condFalse},
+		{`"xyz"`, condTrue},
+		{`"abc-gzip"`, condTrue},
+		{`abc`, condTrue},
+		{``, condNone},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("If-None-Match", tt.header)
+			assert.Equal(t, tt.want, checkIfNoneMatch(req, `"abc"`))
+		})
+	}
+}
+
+// TestCheckIfMatch tests matching If-Match headers against an ETag
+func TestCheckIfMatch(t *testing.T) {
+	tests := []struct {
+		header string
+		want   condResult
+	}{
+		{`"abc"`, condTrue},
+		{`"xyz", "abc"`, condTrue},
+		{`*`, condTrue},
+		{`W/"abc"`, condFalse},
+		{`"xyz"`, condFalse},
+		{``, condNone},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("If-Match", tt.header)
+			assert.Equal(t, tt.want, checkIfMatch(req, `"abc"`))
+		})
+	}
+}
+
+// TestServerHeaderETag tests ETag headers and 304 responses to If-None-Match
+func TestServerHeaderETag(t *testing.T) {
+	body := strings.Repeat("Hello, World!", 100)
+	backend := &countingBackend{
+		Backend: attrsBackend{
+			memoryBackend: memoryBackend{"app.js": []byte(body)},
+			attrs:         ObjectAttrs{MD5: []byte{0x01, 0x02, 0x03}},
+		},
+	}
+	config := GCSStaticConfig{
+		Backend:           backend,
+		RootPath:          "/",
+		EnableCompression: true,
+	}
+
+	tests := []struct {
+		name           string
+		method         string
+		acceptEncoding string
+		ifNoneMatch    string
+		wantStatus     int
+		wantETag       string
+		wantOpened     bool
+	}{
+		{
+			name:       "Identity response",
+			method:     http.MethodGet,
+			wantStatus: http.StatusOK,
+			wantETag:   `"010203"`,
+			wantOpened: true,
+		},
+		{
+			name:           "Compressed response",
+			method:         http.MethodGet,
+			acceptEncoding: "gzip",
+			wantStatus:     http.StatusOK,
+			wantETag:       `"010203-gzip"`,
+			wantOpened:     true,
+		},
+		{
+			name:        "Matching identity ETag",
+			method:      http.MethodGet,
+			ifNoneMatch: `"010203"`,
+			wantStatus:  http.StatusNotModified,
+			wantETag:    `"010203"`,
+		},
+		{
+			name:           "Matching compressed ETag",
+			method:         http.MethodGet,
+			acceptEncoding: "gzip",
+			ifNoneMatch:    `"000000", "010203-gzip"`,
+			wantStatus:     http.StatusNotModified,
+			wantETag:       `"010203-gzip"`,
+		},
+		{
+			name:           "Identity ETag does not match the compressed representation",
+			method:         http.MethodGet,
+			acceptEncoding: "gzip",
+			ifNoneMatch:    `"010203"`,
+			wantStatus:     http.StatusOK,
+			wantETag:       `"010203-gzip"`,
+			wantOpened:     true,
+		},
+		{
+			name:        "Wildcard",
+			method:      http.MethodHead,
+			ifNoneMatch: `*`,
+			wantStatus:  http.StatusNotModified,
+			wantETag:    `"010203"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend.opens.Store(0)
+			req := httptest.NewRequest(tt.method, "/app.js", nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			if tt.ifNoneMatch != "" {
+				req.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			rec := serve(config, req)
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			assert.Equal(t, tt.wantETag, rec.Header().Get("ETag"))
+			assert.Equal(t, "Accept-Encoding", rec.Header().Get(echo.HeaderVary))
+			assert.Equal(t, tt.wantOpened, backend.opens.Load() > 0)
+			if tt.wantStatus == http.StatusNotModified {
+				assert.Zero(t, rec.Body.Len())
+			}
+		})
+	}
+}
+
+// TestServerHeaderLastModified tests Last-Modified headers and the precedence of
+// date-based preconditions against entity tags
+func TestServerHeaderLastModified(t *testing.T) {
+	modtime := time.Date(2024, 5, 1, 12, 0, 0, 500, time.UTC)
+	backend := &countingBackend{
+		Backend: attrsBackend{
+			memoryBackend: memoryBackend{"logo.png": []byte("\x89PNG")},
+			attrs:         ObjectAttrs{MD5: []byte{0xaa}, Updated: modtime},
+		},
+	}
+	config := GCSStaticConfig{
+		Backend:  backend,
+		RootPath: "/",
+	}
+	before := modtime.Add(-time.Hour).Format(http.TimeFormat)
+	same := modtime.Format(http.TimeFormat)
+
+	tests := []struct {
+		name       string
+		method     string
+		header     http.Header
+		wantStatus int
+		wantOpened bool
+	}{
+		{
+			name:       "Unconditional",
+			method:     http.MethodGet,
+			wantStatus: http.StatusOK,
+			wantOpened: true,
+		},
+		{
+			name:       "Not modified since",
+			method:     http.MethodGet,
+			header:     http.Header{"If-Modified-Since": {same}},
+			wantStatus: http.StatusNotModified,
+		},
+		{
+			name:       "Modified since",
+			method:     http.MethodGet,
+			header:     http.Header{"If-Modified-Since": {before}},
+			wantStatus: http.StatusOK,
+			wantOpened: true,
+		},
+		{
+			name:       "Invalid date is ignored",
+			method:     http.MethodGet,
+			header:     http.Header{"If-Modified-Since": {"yesterday"}},
+			wantStatus: http.StatusOK,
+			wantOpened: true,
+		},
+		{
+			name:   "If-None-Match takes precedence over If-Modified-Since",
+			method: http.MethodGet,
+			header: http.Header{
+				"If-None-Match":     {`"other"`},
+				"If-Modified-Since": {same},
+			},
+			wantStatus: http.StatusOK,
+			wantOpened: true,
+		},
+		{
+			name:       "Unmodified since",
+			method:     http.MethodGet,
+			header:     http.Header{"If-Unmodified-Since": {same}},
+			wantStatus: http.StatusOK,
+			wantOpened: true,
+		},
+		{
+			name:       "Modified after If-Unmodified-Since",
+			method:     http.MethodGet,
+			header:     http.Header{"If-Unmodified-Since": {before}},
+			wantStatus: http.StatusPreconditionFailed,
+		},
+		{
+			name:   "If-Match takes precedence over If-Unmodified-Since",
+			method: http.MethodGet,
+			header: http.Header{
+				"If-Match":            {`"aa"`},
+				"If-Unmodified-Since": {before},
+			},
+			wantStatus: http.StatusOK,
+			wantOpened: true,
+		},
+		{
+			name:       "If-Match fails",
+			method:     http.MethodGet,
+			header:     http.Header{"If-Match": {`"other"`}},
+			wantStatus: http.StatusPreconditionFailed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend.opens.Store(0)
+			req := httptest.NewRequest(tt.method, "/logo.png", nil)
+			for k, v := range tt.header {
+				req.Header[k] = v
+			}
+			rec := serve(config, req)
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			assert.Equal(t, tt.wantOpened, backend.opens.Load() > 0)
+			if tt.wantStatus == http.StatusNotModified {
+				// Last-Modified is redundant next to an ETag
+				assert.Empty(t, rec.Header().Get("Last-Modified"))
+				assert.Equal(t, `"aa"`, rec.Header().Get("ETag"))
+			} else {
+				assert.Equal(t, "Wed, 01 May 2024 12:00:00 GMT", rec.Header().Get("Last-Modified"))
+			}
+		})
+	}
+}
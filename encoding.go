@@ -0,0 +1,119 @@
+package gcsmiddleware
+
+import (
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// supportedEncodings lists the content encodings files can be compressed with,
+// in order of preference
+var supportedEncodings = []string{"br", "zstd", "gzip"}
+
+// acceptedCoding is a content coding listed in an Accept-Encoding header along
+// with its quality value
+type acceptedCoding struct {
+	coding string
+	q      float64
+}
+
+// parseAcceptEncoding parses the value of an Accept-Encoding header as per
+// RFC 9110 Section 12.5.3. Codings are lowercased, "x-gzip" is read as "gzip",
+// and entries with an invalid quality value are ignored.
+func parseAcceptEncoding(s string) []acceptedCoding {
+	var codings []acceptedCoding
+	for _, part := range strings.Split(s, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(textproto.TrimString(coding))
+		if coding == "" {
+			continue
+		}
+		if coding == "x-gzip" {
+			coding = "gzip"
+		}
+		q, valid := 1.0, true
+		for _, param := range strings.Split(params, ";") {
+			name, value, _ := strings.Cut(param, "=")
+			if strings.EqualFold(textproto.TrimString(name), "q") {
+				q, valid = parseQValue(textproto.TrimString(value))
+			}
+		}
+		if valid {
+			codings = append(codings, acceptedCoding{coding: coding, q: q})
+		}
+	}
+	return codings
+}
+
+// parseQValue parses a quality value, which must be between 0 and 1
+func parseQValue(s string) (float64, bool) {
+	q, err := strconv.ParseFloat(s, 64)
+	if err != nil || q < 0 || q > 1 {
+		return 0, false
+	}
+	return q, true
+}
+
+// negotiateEncodings returns the supported content encodings acceptable to the
+// client, in order of preference, and whether the identity representation is
+// acceptable. Encodings are ordered by their quality value, with ties broken by
+// the order of supportedEncodings, and encodings the client prefers less than
+// the identity representation are left out. An encoding listed with q=0 is never
+// used, and "*" stands for every encoding that is not listed. Without the header
+// no encoding is used.
+func negotiateEncodings(header http.Header) ([]string, bool) {
+	values, ok := header[echo.HeaderAcceptEncoding]
+	if !ok {
+		return nil, true
+	}
+	codings := parseAcceptEncoding(strings.Join(values, ","))
+
+	// quality returns the quality value of a coding and whether it is listed,
+	// either by name or through "*"
+	quality := func(coding string) (float64, bool) {
+		wildcard, hasWildcard := 0.0, false
+		for _, c := range codings {
+			if c.coding == coding {
+				return c.q, true
+			}
+			if c.coding == "*" && !hasWildcard {
+				wildcard, hasWildcard = c.q, true
+			}
+		}
+		return wildcard, hasWildcard
+	}
+
+	// The identity representation is acceptable unless it is excluded, and
+	// ranks below every encoding if it is not listed
+	identityQ, listed := quality("identity")
+	identity := !listed || identityQ > 0
+
+	var encodings []string
+	qs := make(map[string]float64)
+	for _, encoding := range supportedEncodings {
+		if q, ok := quality(encoding); ok && q > 0 && q >= identityQ {
+			encodings = append(encodings, encoding)
+			qs[encoding] = q
+		}
+	}
+	sort.SliceStable(encodings, func(i, j int) bool {
+		return qs[encodings[i]] > qs[encodings[j]]
+	})
+	return encodings, identity
+}
+
+// selectEncodings returns the content encodings the file may be sent with, in
+// order of preference, and whether it may be sent as is. The file is compressed
+// with the first encoding that works. Range requests are always served from the
+// identity representation.
+func (s *FilesStore) selectEncodings(c echo.Context, result FileResult) ([]string, bool) {
+	encodings, identity := negotiateEncodings(c.Request().Header)
+	if !s.negotiatesEncoding(result) || c.Request().Header.Get("Range") != "" {
+		return nil, identity
+	}
+	return encodings, identity
+}
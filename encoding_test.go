@@ -0,0 +1,223 @@
+package gcsmiddleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestNegotiateEncodings tests choosing content encodings from Accept-Encoding headers
+func TestNegotiateEncodings(t *testing.T) {
+	tests := []struct {
+		name         string
+		header       []string
+		wantEncoding []string
+		wantIdentity bool
+	}{
+		{
+			name:         "No header",
+			wantIdentity: true,
+		},
+		{
+			name:         "Empty header",
+			header:       []string{""},
+			wantIdentity: true,
+		},
+		{
+			name:         "Chrome",
+			header:       []string{"gzip, deflate, br, zstd"},
+			wantEncoding: []string{"br", "zstd", "gzip"},
+			wantIdentity: true,
+		},
+		{
+			name:         "Safari",
+			header:       []string{"gzip, deflate, br"},
+			wantEncoding: []string{"br", "gzip"},
+			wantIdentity: true,
+		},
+		{
+			name:         "curl --compressed",
+			header:       []string{"deflate, gzip, br, zstd"},
+			wantEncoding: []string{"br", "zstd", "gzip"},
+			wantIdentity: true,
+		},
+		{
+			name:         "Go HTTP client",
+			header:       []string{"gzip"},
+			wantEncoding: []string{"gzip"},
+			wantIdentity: true,
+		},
+		{
+			name:         "Legacy x-gzip",
+			header:       []string{"x-gzip, deflate"},
+			wantEncoding: []string{"gzip"},
+			wantIdentity: true,
+		},
+		{
+			name:         "Case insensitive",
+			header:       []string{"GZip, BR"},
+			wantEncoding: []string{"br", "gzip"},
+			wantIdentity: true,
+		},
+		{
+			name:         "Multiple header lines",
+			header:       []string{"gzip", "br"},
+			wantEncoding: []string{"br", "gzip"},
+			wantIdentity: true,
+		},
+		{
+			name:         "Excluded encoding",
+			header:       []string{"br;q=0, gzip"},
+			wantEncoding: []string{"gzip"},
+			wantIdentity: true,
+		},
+		{
+			name:         "Only identity",
+			header:       []string{"gzip;q=0, identity"},
+			wantIdentity: true,
+		},
+		{
+			name:         "Quality values override the server preference",
+			header:       []string{"br;q=0.5, gzip;q=0.8, zstd;q=0.5"},
+			wantEncoding: []string{"gzip", "br", "zstd"},
+			wantIdentity: true,
+		},
+		{
+			name:         "Encodings preferred less than identity",
+			header:       []string{"gzip;q=1.0, br;q=0.5, identity;q=0.8"},
+			wantEncoding: []string{"gzip"},
+			wantIdentity: true,
+		},
+		{
+			name:         "Spaces around parameters",
+			header:       []string{"gzip ; q=0.9 , br ; Q=1"},
+			wantEncoding: []string{"br", "gzip"},
+			wantIdentity: true,
+		},
+		{
+			name:         "Invalid quality value",
+			header:       []string{"br;q=2, gzip;q=abc, zstd"},
+			wantEncoding: []string{"zstd"},
+			wantIdentity: true,
+		},
+		{
+			name:         "Wildcard",
+			header:       []string{"*"},
+			wantEncoding: []string{"br", "zstd", "gzip"},
+			wantIdentity: true,
+		},
+		{
+			name:         "Wildcard does not override listed encodings",
+			header:       []string{"br;q=0, *;q=0.5"},
+			wantEncoding: []string{"zstd", "gzip"},
+			wantIdentity: true,
+		},
+		{
+			name:         "Wildcard excludes identity",
+			header:       []string{"gzip, *;q=0"},
+			wantEncoding: []string{"gzip"},
+		},
+		{
+			name:         "Identity excluded",
+			header:       []string{"gzip, identity;q=0"},
+			wantEncoding: []string{"gzip"},
+		},
+		{
+			name:   "Nothing acceptable",
+			header: []string{"deflate, identity;q=0"},
+		},
+		{
+			name:         "Identity listed explicitly despite the wildcard",
+			header:       []string{"*;q=0, identity"},
+			wantIdentity: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.header != nil {
+				header[echo.HeaderAcceptEncoding] = tt.header
+			}
+			encodings, identity := negotiateEncodings(header)
+			assert.Equal(t, tt.wantEncoding, encodings)
+			assert.Equal(t, tt.wantIdentity, identity)
+		})
+	}
+}
+
+// TestServerHeaderNotAcceptable tests answering requests that accept no available
+// representation with 406 Not Acceptable
+func TestServerHeaderNotAcceptable(t *testing.T) {
+	body := strings.Repeat("Hello, World!", 100)
+	config := GCSStaticConfig{
+		Backend: memoryBackend{
+			"index.html": []byte(body),
+			"logo.png":   []byte(body),
+		},
+		RootPath:          "/",
+		EnableCompression: true,
+	}
+
+	tests := []struct {
+		name           string
+		target         string
+		acceptEncoding string
+		brotliLevel    int
+		wantStatus     int
+		wantEncoding   string
+	}{
+		{
+			name:           "Identity only",
+			target:         "/index.html",
+			acceptEncoding: "gzip;q=0, identity",
+			wantStatus:     http.StatusOK,
+		},
+		{
+			name:           "Compressed representation",
+			target:         "/index.html",
+			acceptEncoding: "gzip, identity;q=0",
+			wantStatus:     http.StatusOK,
+			wantEncoding:   "gzip",
+		},
+		{
+			name:           "No acceptable encoding",
+			target:         "/index.html",
+			acceptEncoding: "deflate, identity;q=0",
+			wantStatus:     http.StatusNotAcceptable,
+		},
+		{
+			name:           "Failing encoding without identity",
+			target:         "/index.html",
+			acceptEncoding: "br, *;q=0",
+			brotliLevel:    20,
+			wantStatus:     http.StatusNotAcceptable,
+		},
+		{
+			name:           "File that is never compressed",
+			target:         "/logo.png",
+			acceptEncoding: "gzip, identity;q=0",
+			wantStatus:     http.StatusNotAcceptable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := config
+			config.BrotliLevel = tt.brotliLevel
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			rec := serve(config, req)
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			assert.Equal(t, tt.wantEncoding, rec.Header().Get(echo.HeaderContentEncoding))
+			if tt.wantStatus == http.StatusOK && tt.wantEncoding == "" {
+				assert.Equal(t, body, rec.Body.String())
+			}
+		})
+	}
+}
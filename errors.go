@@ -0,0 +1,53 @@
+package gcsmiddleware
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// StatusClientClosedRequest is the non-standard status code, introduced by nginx,
+// that requests abandoned by the client are answered with. The client never sees
+// it, but access logs and metrics can tell these requests apart from failures.
+const StatusClientClosedRequest = 499
+
+// errorStatus returns the HTTP status code a backend error is answered with.
+// A missing object is a 404 Not Found and a request cancelled by the client is a
+// 499 Client Closed Request, while every other failure says something about the
+// backend rather than the request: a denied read is reported as 403 Forbidden,
+// broken credentials as 500 Internal Server Error, a timeout as 504 Gateway
+// Timeout and anything else as 502 Bad Gateway.
+func errorStatus(err error) int {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrObjectNotExist):
+		return http.StatusNotFound
+	case errors.Is(err, context.Canceled):
+		return StatusClientClosedRequest
+	case errors.Is(err, ErrPermissionDenied):
+		return http.StatusForbidden
+	case errors.Is(err, ErrUnauthenticated):
+		return http.StatusInternalServerError
+	case errors.Is(err, ErrTimeout), errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// backendError converts a backend error into an echo.HTTPError so that Echo's
+// HTTPErrorHandler can render it. The backend error is kept as the internal error
+// for logging and is not exposed to the client.
+func backendError(err error) *echo.HTTPError {
+	return echo.NewHTTPError(errorStatus(err)).SetInternal(err)
+}
+
+// isNotExist reports whether err means that the requested object does not exist
+func isNotExist(err error) bool {
+	return errors.Is(err, ErrObjectNotExist)
+}
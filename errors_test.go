@@ -0,0 +1,154 @@
+package gcsmiddleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// failingBackend is a memoryBackend that returns an error for some objects
+type failingBackend struct {
+	memoryBackend
+	errs map[string]error
+}
+
+func (b failingBackend) Stat(ctx context.Context, name string) (*ObjectAttrs, error) {
+	if err := b.errs[name]; err != nil {
+		return nil, err
+	}
+	return b.memoryBackend.Stat(ctx, name)
+}
+
+func (b failingBackend) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	if err := b.errs[name]; err != nil {
+		return nil, err
+	}
+	return b.memoryBackend.Open(ctx, name)
+}
+
+// timeoutError is a net.Error that timed out
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var _ net.Error = timeoutError{}
+
+// TestErrorStatus tests mapping backend errors to HTTP status codes
+func TestErrorStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"Missing object", ErrObjectNotExist, http.StatusNotFound},
+		{"Wrapped missing object", fmt.Errorf("stat: %w", ErrObjectNotExist), http.StatusNotFound},
+		{"Permission denied", ErrPermissionDenied, http.StatusForbidden},
+		{"Unauthenticated", ErrUnauthenticated, http.StatusInternalServerError},
+		{"Backend timeout", ErrTimeout, http.StatusGatewayTimeout},
+		{"Context deadline", fmt.Errorf("read: %w", context.DeadlineExceeded), http.StatusGatewayTimeout},
+		{"Network timeout", &net.OpError{Op: "read", Err: timeoutError{}}, http.StatusGatewayTimeout},
+		{"Cancelled request", fmt.Errorf("read: %w", context.Canceled), StatusClientClosedRequest},
+		{"Replaced generation", fmt.Errorf("read: %w", errGenerationReplaced), http.StatusBadGateway},
+		{"Other failure", errors.New("connection reset"), http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, errorStatus(tt.err))
+		})
+	}
+}
+
+// TestGCSError tests translating errors of the storage package into backend errors
+func TestGCSError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"JSON API 401", &googleapi.Error{Code: http.StatusUnauthorized}, ErrUnauthenticated},
+		{"JSON API 403", &googleapi.Error{Code: http.StatusForbidden}, ErrPermissionDenied},
+		{"JSON API 504", &googleapi.Error{Code: http.StatusGatewayTimeout}, ErrTimeout},
+		{"gRPC unauthenticated", status.Error(codes.Unauthenticated, "no token"), ErrUnauthenticated},
+		{"gRPC permission denied", status.Error(codes.PermissionDenied, "denied"), ErrPermissionDenied},
+		{"gRPC deadline exceeded", status.Error(codes.DeadlineExceeded, "slow"), ErrTimeout},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := gcsError(tt.err)
+			assert.ErrorIs(t, err, tt.want)
+			assert.ErrorIs(t, err, tt.err)
+		})
+	}
+
+	other := &googleapi.Error{Code: http.StatusServiceUnavailable}
+	assert.Equal(t, error(other), gcsError(other))
+}
+
+// TestServerHeaderBackendErrors tests that backend failures are returned as echo.HTTPError
+// and never fall back to index.html
+func TestServerHeaderBackendErrors(t *testing.T) {
+	backend := failingBackend{
+		memoryBackend: memoryBackend{"index.html": []byte("<html>app</html>")},
+		errs: map[string]error{
+			"main.js":            fmt.Errorf("%w: 403", ErrPermissionDenied),
+			"chunk.js":           ErrTimeout,
+			"reports.json":       errors.New("backend unavailable"),
+			"reports/index.html": errors.New("backend unavailable"),
+			"unauthorized.css":   ErrUnauthenticated,
+		},
+	}
+
+	tests := []struct {
+		target     string
+		isSPA      bool
+		wantStatus int
+	}{
+		{"/main.js", false, http.StatusForbidden},
+		{"/chunk.js", false, http.StatusGatewayTimeout},
+		{"/reports.json", false, http.StatusBadGateway},
+		{"/missing.js", false, http.StatusNotFound},
+		{"/unauthorized.css", false, http.StatusInternalServerError},
+		{"/main.js", true, http.StatusForbidden},
+		{"/reports.json", true, http.StatusBadGateway},
+		{"/reports", true, http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s SPA=%t", tt.target, tt.isSPA), func(t *testing.T) {
+			config := GCSStaticConfig{
+				Backend:  backend,
+				RootPath: "/",
+				IsSPA:    tt.isSPA,
+			}
+			fs := NewGCSStaticMiddleware(config)
+			e := echo.New()
+			rec := httptest.NewRecorder()
+			c := e.NewContext(httptest.NewRequest(http.MethodGet, tt.target, nil), rec)
+			err := fs.ServerHeader(func(c echo.Context) error {
+				return c.String(http.StatusTeapot, "next")
+			})(c)
+
+			var he *echo.HTTPError
+			if assert.ErrorAs(t, err, &he) {
+				assert.Equal(t, tt.wantStatus, he.Code)
+				assert.Error(t, he.Internal)
+			}
+			assert.False(t, c.Response().Committed)
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package gcsmiddleware
+
+import (
+	"context"
+	"path"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// pathPlaceholder is replaced by the requested path in the entries of Fallbacks
+const pathPlaceholder = "{path}"
+
+// fallbackPaths returns the objects that may answer the request, in order of
+// preference. Without Fallbacks this is the file named by the request, followed
+// by index.html in SPA mode.
+func (s *FilesStore) fallbackPaths(c echo.Context) []string {
+	if s.config.Fallbacks == nil {
+		paths := []string{s.filePath(c)}
+		if s.config.IsSPA {
+			paths = append(paths, "index.html")
+		}
+		return paths
+	}
+
+	reqPath := strings.Trim(s.relativePath(c), "/")
+	paths := make([]string, 0, len(s.config.Fallbacks))
+	seen := make(map[string]bool, len(s.config.Fallbacks))
+	for _, entry := range s.config.Fallbacks {
+		// Entries such as "{path}.html" name nothing for the root path
+		if reqPath == "" && strings.HasPrefix(entry, pathPlaceholder) && !strings.HasPrefix(entry, pathPlaceholder+"/") {
+			continue
+		}
+		name := strings.TrimPrefix(path.Clean("/"+strings.ReplaceAll(entry, pathPlaceholder, reqPath)), "/")
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		paths = append(paths, name)
+	}
+	return paths
+}
+
+// fileLookup is a lookup of one entry of a fallbackChain
+type fileLookup struct {
+	path   string
+	cancel context.CancelFunc
+	done   chan struct{}
+	result FileResult
+}
+
+// fallbackChain resolves the first existing file of a list of paths. The entries
+// are always resolved in order, so an entry is only chosen once every entry
+// before it is known to be missing, regardless of which lookup finishes first.
+// With prefetching all lookups are started at once and the ones that lost are
+// cancelled as soon as the winner is known.
+type fallbackChain struct {
+	store   *FilesStore
+	ctx     context.Context
+	lookups []*fileLookup
+	next    int
+}
+
+// newFallbackChain returns a chain for paths whose lookups run under ctx.
+// If prefetch is true, the lookups of all paths are started right away.
+// The chain must be closed to release lookups that were never needed.
+func (s *FilesStore) newFallbackChain(ctx context.Context, paths []string, prefetch bool) *fallbackChain {
+	chain := &fallbackChain{
+		store:   s,
+		ctx:     ctx,
+		lookups: make([]*fileLookup, len(paths)),
+	}
+	for i, path := range paths {
+		chain.lookups[i] = &fileLookup{path: path}
+		if prefetch {
+			chain.start(i)
+		}
+	}
+	return chain
+}
+
+// start starts the lookup of the i-th entry unless it is already running
+func (ch *fallbackChain) start(i int) {
+	lookup := ch.lookups[i]
+	if lookup.done != nil {
+		return
+	}
+	var ctx context.Context
+	ctx, lookup.cancel = context.WithCancel(ch.ctx)
+	lookup.done = make(chan struct{})
+	go func() {
+		defer close(lookup.done)
+		lookup.result = ch.store.getFile(ctx, lookup.path)
+	}()
+}
+
+// resolve resolves the entries up to end that have not been resolved yet, in order.
+// It returns the first file that exists or the first error other than a missing
+// object, cancelling the lookups of all later entries. If every entry is missing,
+// the result of the last one is returned.
+func (ch *fallbackChain) resolve(end int) FileResult {
+	result := FileResult{Err: ErrObjectNotExist}
+	for end = min(end, len(ch.lookups)); ch.next < end; ch.next++ {
+		ch.start(ch.next)
+		lookup := ch.lookups[ch.next]
+		<-lookup.done
+		result = lookup.result
+		if result.Err == nil || !isNotExist(result.Err) {
+			ch.cancelFrom(ch.next + 1)
+			ch.next = len(ch.lookups)
+			break
+		}
+	}
+	return result
+}
+
+// firstExisting returns the index and file of the first entry that exists, skipping
+// entries whose lookup failed for any reason, and cancels the lookups of all later
+// entries. It returns -1 if no entry exists.
+func (ch *fallbackChain) firstExisting() (int, FileResult) {
+	for i, lookup := range ch.lookups {
+		ch.start(i)
+		<-lookup.done
+		if lookup.result.Err == nil {
+			ch.cancelFrom(i + 1)
+			return i, lookup.result
+		}
+	}
+	return -1, FileResult{}
+}
+
+// len returns the number of entries in the chain
+func (ch *fallbackChain) len() int {
+	return len(ch.lookups)
+}
+
+// cancelFrom cancels the running lookups of the entries from i on
+func (ch *fallbackChain) cancelFrom(i int) {
+	for _, lookup := range ch.lookups[i:] {
+		if lookup.cancel != nil {
+			lookup.cancel()
+		}
+	}
+}
+
+// Close cancels all lookups that are still running
+func (ch *fallbackChain) Close() {
+	ch.cancelFrom(0)
+}
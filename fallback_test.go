@@ -0,0 +1,242 @@
+package gcsmiddleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// gatedBackend is a memoryBackend whose lookups of the gated objects wait until
+// their gate is closed or their context is done. Every lookup is reported on
+// looked, and the context errors of cancelled lookups on errs.
+type gatedBackend struct {
+	memoryBackend
+	gates  map[string]chan struct{}
+	looked chan string
+	errs   chan error
+}
+
+func (b gatedBackend) Stat(ctx context.Context, name string) (*ObjectAttrs, error) {
+	if gate, ok := b.gates[name]; ok {
+		select {
+		case <-gate:
+		case <-ctx.Done():
+			b.errs <- ctx.Err()
+			return nil, ctx.Err()
+		}
+	}
+	defer func() { b.looked <- name }()
+	return b.memoryBackend.Stat(ctx, name)
+}
+
+// TestFallbackPaths tests expanding the fallback chain of a request
+func TestFallbackPaths(t *testing.T) {
+	chain := []string{"{path}", "{path}.html", "{path}/index.html", "200.html", "index.html"}
+
+	tests := []struct {
+		name       string
+		config     GCSStaticConfig
+		requestURL string
+		want       []string
+	}{
+		{
+			name:       "Default chain",
+			config:     GCSStaticConfig{RootPath: "/"},
+			requestURL: "/about",
+			want:       []string{"about"},
+		},
+		{
+			name:       "Default SPA chain",
+			config:     GCSStaticConfig{RootPath: "/", IsSPA: true},
+			requestURL: "/about",
+			want:       []string{"about/index.html", "index.html"},
+		},
+		{
+			name:       "Configured chain",
+			config:     GCSStaticConfig{RootPath: "/", Fallbacks: chain},
+			requestURL: "/docs/about",
+			want:       []string{"docs/about", "docs/about.html", "docs/about/index.html", "200.html", "index.html"},
+		},
+		{
+			name:       "Configured chain with root path",
+			config:     GCSStaticConfig{RootPath: "/app/", Fallbacks: chain},
+			requestURL: "/app/about/",
+			want:       []string{"about", "about.html", "about/index.html", "200.html", "index.html"},
+		},
+		{
+			name:       "Root of the configured chain",
+			config:     GCSStaticConfig{RootPath: "/", Fallbacks: chain},
+			requestURL: "/",
+			want:       []string{"index.html", "200.html"},
+		},
+		{
+			name:       "Path traversal",
+			config:     GCSStaticConfig{RootPath: "/", Fallbacks: chain},
+			requestURL: "/../secret",
+			want:       []string{"secret", "secret.html", "secret/index.html", "200.html", "index.html"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := &FilesStore{config: tt.config}
+			c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), httptest.NewRecorder())
+			c.Request().URL.Path = tt.requestURL
+			assert.Equal(t, tt.want, fs.fallbackPaths(c))
+		})
+	}
+}
+
+// TestFallbackChainOrder tests that the first existing entry wins even if a later
+// entry is found first
+func TestFallbackChainOrder(t *testing.T) {
+	gate := make(chan struct{})
+	backend := gatedBackend{
+		memoryBackend: memoryBackend{"main.js": []byte("console.log(1)"), "index.html": []byte("<html>app</html>")},
+		gates:         map[string]chan struct{}{"main.js": gate},
+		looked:        make(chan string, 2),
+		errs:          make(chan error, 2),
+	}
+	fs := &FilesStore{backend: backend}
+
+	chain := fs.newFallbackChain(context.Background(), []string{"main.js", "index.html"}, true)
+	defer chain.Close()
+
+	// index.html is known before main.js is looked up
+	assert.Equal(t, "index.html", <-backend.looked)
+	close(gate)
+
+	result := chain.resolve(chain.len())
+	assert.NoError(t, result.Err)
+	assert.Equal(t, "main.js", result.Path)
+}
+
+// TestFallbackChainCancel tests that lookups of the entries that lost are cancelled
+// as soon as the winner is known
+func TestFallbackChainCancel(t *testing.T) {
+	backend := gatedBackend{
+		memoryBackend: memoryBackend{"main.js": []byte("console.log(1)")},
+		gates: map[string]chan struct{}{
+			"200.html":   make(chan struct{}),
+			"index.html": make(chan struct{}),
+		},
+		looked: make(chan string, 3),
+		errs:   make(chan error, 2),
+	}
+	fs := &FilesStore{backend: backend}
+
+	chain := fs.newFallbackChain(context.Background(), []string{"main.js", "200.html", "index.html"}, true)
+	defer chain.Close()
+
+	result := chain.resolve(1)
+	assert.NoError(t, result.Err)
+	assert.Equal(t, "main.js", result.Path)
+	assert.ErrorIs(t, <-backend.errs, context.Canceled)
+	assert.ErrorIs(t, <-backend.errs, context.Canceled)
+}
+
+// TestFallbackChainSequential tests that without prefetching entries are only
+// looked up until the winner is found, and that backend errors end the chain
+func TestFallbackChainSequential(t *testing.T) {
+	backend := &countingBackend{
+		Backend: failingBackend{
+			memoryBackend: memoryBackend{"about.html": []byte("about"), "index.html": []byte("<html>app</html>")},
+			errs:          map[string]error{"broken": errors.New("backend unavailable")},
+		},
+	}
+	fs := &FilesStore{backend: backend}
+
+	tests := []struct {
+		name      string
+		paths     []string
+		wantPath  string
+		wantErr   bool
+		wantStats int32
+	}{
+		{
+			name:      "First entry exists",
+			paths:     []string{"about.html", "index.html"},
+			wantPath:  "about.html",
+			wantStats: 1,
+		},
+		{
+			name:      "Later entry exists",
+			paths:     []string{"about", "about.html", "index.html"},
+			wantPath:  "about.html",
+			wantStats: 2,
+		},
+		{
+			name:      "Backend error ends the chain",
+			paths:     []string{"broken", "index.html"},
+			wantErr:   true,
+			wantStats: 1,
+		},
+		{
+			name:      "No entry exists",
+			paths:     []string{"missing", "missing.html"},
+			wantErr:   true,
+			wantStats: 2,
+		},
+		{
+			name:    "Empty chain",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend.stats.Store(0)
+			chain := fs.newFallbackChain(context.Background(), tt.paths, false)
+			defer chain.Close()
+
+			result := chain.resolve(chain.len())
+			assert.Equal(t, tt.wantErr, result.Err != nil)
+			if !tt.wantErr {
+				assert.Equal(t, tt.wantPath, result.Path)
+			}
+			assert.Equal(t, tt.wantStats, backend.stats.Load())
+		})
+	}
+}
+
+// TestServerHeaderFallbacks tests serving requests through a configured fallback chain
+func TestServerHeaderFallbacks(t *testing.T) {
+	config := GCSStaticConfig{
+		Backend: memoryBackend{
+			"about.html":      []byte("about"),
+			"docs/index.html": []byte("docs"),
+			"200.html":        []byte("app"),
+			"index.html":      []byte("home"),
+		},
+		RootPath:  "/",
+		Fallbacks: []string{"{path}", "{path}.html", "{path}/index.html", "200.html", "index.html"},
+	}
+
+	tests := []struct {
+		requestURL string
+		wantBody   string
+	}{
+		{"/about.html", "about"},
+		{"/about", "about"},
+		{"/docs", "docs"},
+		{"/", "home"},
+		{"/settings/profile", "app"},
+	}
+
+	for _, tt := range tests {
+		for _, prefetch := range []bool{false, true} {
+			t.Run(tt.requestURL, func(t *testing.T) {
+				config.PrefetchFallbacks = prefetch
+				rec := serve(config, httptest.NewRequest(http.MethodGet, tt.requestURL, nil))
+
+				assert.Equal(t, http.StatusOK, rec.Code)
+				assert.Equal(t, tt.wantBody, rec.Body.String())
+			})
+		}
+	}
+}
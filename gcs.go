@@ -4,58 +4,153 @@
 package gcsmiddleware
 
 import (
-	"cloud.google.com/go/storage"
 	"bytes"
-	"context"
 	"compress/gzip"
+	"context"
+	"errors"
 	"fmt"
-	"github.com/labstack/echo/v4"
 	"io"
 	"mime"
 	"net/http"
 	"path"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/labstack/echo/v4"
 )
 
 // GCSStaticConfig holds configuration details for a static server setup.
 // This configuration is used to initialize the middleware with necessary GCS settings
 // and behavioral options.
 type GCSStaticConfig struct {
-	// Client is the initialized Google Cloud Storage client
+	// Client is the initialized Google Cloud Storage client.
+	// It is only used when Backend is nil
 	Client *storage.Client
 
-	// BucketName is the name of the GCS bucket to serve files from
+	// BucketName is the name of the GCS bucket to serve files from.
+	// It is only used when Backend is nil, and to key the objects in Cache
 	BucketName string
 
+	// Backend is the storage the files are served from.
+	// If nil, a GCS backend is created from Client and BucketName
+	Backend Backend
+
+	// Skipper defines a function to skip this middleware. Requests for which it returns
+	// true are passed to the next handler. Any middleware.Skipper from Echo can be used
+	Skipper func(c echo.Context) bool
+
 	// IgnorePath is a list of paths that should bypass this middleware
 	IgnorePath []string
 
+	// IgnorePathPrefix is a list of path prefixes that should bypass this middleware.
+	// For example, "/api/" ignores the entire /api subtree
+	IgnorePathPrefix []string
+
+	// IgnorePathGlob is a list of path.Match patterns of paths that should bypass
+	// this middleware. Note that "*" does not match "/", so "/api/*" ignores
+	// "/api/users" but not "/api/users/42". NewGCSStaticMiddleware panics if a
+	// pattern is malformed
+	IgnorePathGlob []string
+
+	// IgnorePathRegexp is a list of regular expressions matching paths that should
+	// bypass this middleware
+	IgnorePathRegexp []*regexp.Regexp
+
 	// IsSPA indicates whether the server should handle routes as a Single Page Application.
 	// When true, missing files will fall back to serving index.html
 	IsSPA bool
 
+	// Fallbacks is the chain of objects tried for a request, in order. "{path}" in an
+	// entry is replaced by the requested path relative to RootPath, for example
+	// []string{"{path}", "{path}.html", "{path}/index.html", "200.html", "index.html"}.
+	// The first entry names the requested file, the others are served in its place.
+	// If nil, the chain is the requested file, followed by index.html if IsSPA is set
+	Fallbacks []string
+
+	// PrefetchFallbacks looks up all entries of the fallback chain in parallel instead
+	// of one after the other. The first existing entry is still the one served, and
+	// the remaining lookups are cancelled as soon as it is known
+	PrefetchFallbacks bool
+
+	// FallThrough passes requests for missing files to the next handler instead of
+	// answering them with 404 Not Found, so files and Echo routes can share the same
+	// URL space. In SPA mode, index.html is only served if no route matched either;
+	// a 404 returned by a matched route is passed on as it is
+	FallThrough bool
+
 	// RootPath specifies the base path from which files are served.
 	// For example, if RootPath is "/static/", a request to "/static/css/style.css"
-	// will serve the file at "css/style.css" in the bucket
+	// will serve the file at "css/style.css" in the bucket. Default is "/" if not specified
 	RootPath string
 
-	// EnableCompression enables gzip/brotli compression for text-based files
+	// EnableCompression enables brotli, zstd and gzip compression for text-based files.
+	// HEAD requests for a compressed response only get a Content-Length once the
+	// compressed representation is held by the Cache, as the content is not read
+	// to answer them
 	EnableCompression bool
 
-	// CompressionLevel specifies the compression level (1-9, higher means better compression but slower)
+	// CompressionLevel specifies the gzip compression level (1-9, higher means better compression but slower)
 	// Default is 6 if not specified
 	CompressionLevel int
 
+	// BrotliLevel specifies the brotli compression level (1-11, higher means better compression but slower)
+	// Default is 6 if not specified
+	BrotliLevel int
+
+	// ZstdLevel specifies the zstd compression level (1-22, higher means better compression but slower)
+	// Default is 3 if not specified
+	ZstdLevel int
+
 	// MinSizeForCompression specifies the minimum file size in bytes for compression
 	// Files smaller than this size will not be compressed
 	MinSizeForCompression int64
+
+	// ServePrecompressed serves compressed copies of text-based files uploaded next
+	// to them, such as "main.js.br", "main.js.zst" or "main.js.gz", to clients that
+	// accept their encoding. A file without a matching copy is compressed as usual,
+	// or sent as is. The copies are streamed regardless of their size
+	ServePrecompressed bool
+
+	// StreamThreshold specifies the file size in bytes above which a file is never
+	// buffered in memory. Larger files are streamed to the client uncompressed,
+	// unless StreamCompression is set. Files that are not compressed are always
+	// streamed regardless of their size. Default is 8 MiB if not specified
+	StreamThreshold int64
+
+	// StreamCompression compresses files above StreamThreshold while they are
+	// streamed instead of sending them uncompressed. The compressed length is not
+	// known in advance, so these responses have no Content-Length and are sent
+	// with chunked transfer encoding
+	StreamCompression bool
+
+	// StatTimeout limits how long retrieving the attributes of a file may take.
+	// Zero means the lookup is only bounded by the request context
+	StatTimeout time.Duration
+
+	// ReadTimeout limits how long reading the contents of a file may take, from
+	// opening the object until the last byte has been sent to the client.
+	// Zero means the read is only bounded by the request context
+	ReadTimeout time.Duration
+
+	// Cache is an optional in-memory cache in front of the backend. It can be shared
+	// between middlewares serving different buckets, as its entries are keyed by
+	// BucketName. If nil, every request goes to the backend
+	Cache *Cache
 }
 
-// FilesStore manages the GCS client and handles file operations.
+// defaultStreamThreshold is the StreamThreshold used when none is configured
+const defaultStreamThreshold = 8 << 20
+
+// FilesStore manages the storage backend and handles file operations.
 // It implements the StaticServerMiddlewareInterface for serving static files.
 type FilesStore struct {
-	config GCSStaticConfig
+	config  GCSStaticConfig
+	backend Backend
 }
 
 // StaticServerMiddlewareInterface defines methods for handling server headers and file retrieval
@@ -68,6 +163,7 @@ type StaticServerMiddlewareInterface interface {
 
 // NewGCSStaticMiddleware initializes and returns a new instance of FilesStore with the provided GCSStaticConfig.
 // It creates a middleware that can serve static files from Google Cloud Storage.
+// Like regexp.MustCompile, it panics if a pattern of IgnorePathGlob is malformed.
 //
 // Parameters:
 //   - config: GCSStaticConfig containing the necessary configuration for GCS connection and behavior
@@ -75,14 +171,31 @@ type StaticServerMiddlewareInterface interface {
 // Returns:
 //   - StaticServerMiddlewareInterface that can be used with Echo's Use() method
 func NewGCSStaticMiddleware(config GCSStaticConfig) StaticServerMiddlewareInterface {
+	for _, pattern := range config.IgnorePathGlob {
+		if _, err := path.Match(pattern, ""); err != nil {
+			panic(fmt.Sprintf("gcsmiddleware: IgnorePathGlob %q: %v", pattern, err))
+		}
+	}
+	backend := config.Backend
+	if backend == nil {
+		backend = NewGCSBackend(config.Client, config.BucketName)
+	}
+	if config.Cache != nil {
+		backend = newCachedBackend(config.Cache, config.BucketName, backend)
+	}
 	return &FilesStore{
-		config: config,
+		config:  config,
+		backend: backend,
 	}
 }
 
 // ServerHeader is a middleware that handles serving files from a GCS bucket.
 // It processes the request path, retrieves files from GCS, and sets appropriate
-// response headers. For SPA mode, it falls back to serving index.html for missing files.
+// response headers. Missing files fall back to the next entry of the fallback
+// chain, which in SPA mode ends with index.html.
+// Backend failures are returned as echo.HTTPError for Echo's HTTPErrorHandler.
+// Only GET and HEAD requests are served; requests with other methods are passed
+// to the next handler.
 //
 // Parameters:
 //   - next: The next middleware handler in the chain
@@ -91,60 +204,287 @@ func NewGCSStaticMiddleware(config GCSStaticConfig) StaticServerMiddlewareInterf
 //   - echo.HandlerFunc that processes the request and serves the file
 func (s *FilesStore) ServerHeader(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		for _, ignorePath := range s.config.IgnorePath {
-			if c.Request().URL.Path == ignorePath {
-				return next(c)
-			}
+		if s.skip(c) {
+			return next(c)
 		}
-		filePath := s.filePath(c)
-		
-		// Prepare paths for potential parallel retrieval
-		paths := []string{filePath}
-		if s.config.IsSPA {
-			paths = append(paths, "index.html") // Add index.html for SPA mode
+		if method := c.Request().Method; method != http.MethodGet && method != http.MethodHead {
+			return s.handleOtherMethod(c, next)
 		}
+		chain := s.newFallbackChain(c.Request().Context(), s.fallbackPaths(c), s.config.PrefetchFallbacks)
+		defer chain.Close()
 
-		// Get files in parallel
-		results := s.getFiles(paths)
-
-		// Process main file result
-		fileResult := results[0]
+		// Process the requested file
+		fileResult := chain.resolve(1)
 		if fileResult.Err != nil {
-			if s.config.IsSPA {
-				// Use index.html result if available
-				indexResult := results[1]
-				if indexResult.Err == nil {
-					c.Response().Header().Set("Content-Length", strconv.FormatInt(indexResult.Size, 10))
-					return c.Blob(http.StatusOK, indexResult.ContentType, indexResult.Body)
+			// Only a missing file falls back, so that a failing backend is
+			// never mistaken for a client-side route
+			if !isNotExist(fileResult.Err) {
+				return backendError(fileResult.Err)
+			}
+			hasFallbacks := chain.len() > 1
+			if s.config.FallThrough {
+				// Let the routes handle the request, falling back to the rest
+				// of the chain only if none of them matched. A 404 returned by
+				// a matched route is the route's answer and is left alone.
+				err := next(c)
+				if !hasFallbacks || !noRouteMatched(err) || c.Response().Committed {
+					return err
 				}
+			} else if !hasFallbacks {
+				return backendError(fileResult.Err)
+			}
+			fileResult = chain.resolve(chain.len())
+			if fileResult.Err != nil {
+				return backendError(fileResult.Err)
 			}
-			return c.NoContent(http.StatusNotFound)
 		}
+		return s.serveResolved(c, fileResult)
+	}
+}
 
-		// Check if compression is possible
-		if s.shouldCompress(fileResult.ContentType, fileResult.Size) {
-			acceptEncoding := c.Request().Header.Get("Accept-Encoding")
-			var encoding string
-			if strings.Contains(acceptEncoding, "br") {
-				encoding = "br"
-			} else if strings.Contains(acceptEncoding, "gzip") {
-				encoding = "gzip"
-			}
+// skip reports whether the request should bypass this middleware, either because
+// the Skipper says so or because its path matches one of the ignored paths
+func (s *FilesStore) skip(c echo.Context) bool {
+	if s.config.Skipper != nil && s.config.Skipper(c) {
+		return true
+	}
+	reqPath := c.Request().URL.Path
+	for _, ignorePath := range s.config.IgnorePath {
+		if reqPath == ignorePath {
+			return true
+		}
+	}
+	for _, prefix := range s.config.IgnorePathPrefix {
+		if strings.HasPrefix(reqPath, prefix) {
+			return true
+		}
+	}
+	// The patterns have been validated by NewGCSStaticMiddleware
+	for _, pattern := range s.config.IgnorePathGlob {
+		if ok, _ := path.Match(pattern, reqPath); ok {
+			return true
+		}
+	}
+	for _, re := range s.config.IgnorePathRegexp {
+		if re.MatchString(reqPath) {
+			return true
+		}
+	}
+	return false
+}
 
-			if encoding != "" {
-				compressed, err := s.compressData(fileResult.Body, encoding)
-				if err == nil {
-					c.Response().Header().Set("Content-Encoding", encoding)
-					c.Response().Header().Set("Content-Length", strconv.Itoa(len(compressed)))
-					c.Response().Header().Set("Vary", "Accept-Encoding")
-					return c.Blob(http.StatusOK, fileResult.ContentType, compressed)
-				}
-			}
+// allowedMethods lists the methods files can be requested with, for the Allow header
+const allowedMethods = "GET, HEAD, OPTIONS"
+
+// handleOtherMethod passes requests with methods other than GET and HEAD to the next
+// handler. Only when no route accepts the request and its path names an existing file
+// does the middleware answer for the file: OPTIONS with the allowed methods, and any
+// other method with 405 Method Not Allowed.
+func (s *FilesStore) handleOtherMethod(c echo.Context, next echo.HandlerFunc) error {
+	err := next(c)
+	if code := httpErrorCode(err); code != http.StatusNotFound && code != http.StatusMethodNotAllowed {
+		return err
+	}
+	if s.getFile(c.Request().Context(), s.filePath(c)).Err != nil {
+		return err
+	}
+
+	c.Response().Header().Set(echo.HeaderAllow, allowedMethods)
+	if c.Request().Method == http.MethodOptions {
+		return c.NoContent(http.StatusNoContent)
+	}
+	return c.NoContent(http.StatusMethodNotAllowed)
+}
+
+// noRouteMatched reports whether err is the error Echo's router answers a request
+// with when none of the routes match it, as opposed to a 404 returned by a handler.
+// Only NotFoundHandler returns echo.ErrNotFound itself; handlers create their own
+// errors with echo.NewHTTPError.
+func noRouteMatched(err error) bool {
+	return errors.Is(err, echo.ErrNotFound)
+}
+
+// httpErrorCode returns the status code of an echo.HTTPError, or 0 for any other error
+func httpErrorCode(err error) int {
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		return he.Code
+	}
+	return 0
+}
+
+// serveResolved serves a file resolved by the fallback chain. If the generation its
+// attributes describe was replaced before its content could be read, the attributes
+// are retrieved again and the file is served once more, so that a replaced object
+// is not reported as missing.
+func (s *FilesStore) serveResolved(c echo.Context, fileResult FileResult) error {
+	header := c.Response().Header().Clone()
+	err := s.serveFile(c, fileResult)
+	if !errors.Is(err, errGenerationReplaced) || c.Response().Committed {
+		return err
+	}
+
+	// Start over from the headers set before the file was served
+	for key := range c.Response().Header() {
+		c.Response().Header().Del(key)
+	}
+	for key, values := range header {
+		c.Response().Header()[key] = values
+	}
+	fileResult = s.getFile(c.Request().Context(), fileResult.Path)
+	if fileResult.Err != nil {
+		return backendError(fileResult.Err)
+	}
+	return s.serveFile(c, fileResult)
+}
+
+// staleWarning is the Warning header of responses served from stale cache entries
+const staleWarning = `110 - "Response is Stale"`
+
+// serveFile writes the resolved file to the response. Conditional and HEAD requests
+// are answered from the file attributes alone, range requests with only the requested
+// bytes, compressible files are compressed when the client accepts it, and all
+// other files are streamed as they are, unless a precompressed copy is served in
+// their place. Files stored compressed are handled by serveStoredEncoded. Requests
+// that accept neither a supported encoding nor the identity representation are
+// answered with 406 Not Acceptable.
+func (s *FilesStore) serveFile(c echo.Context, fileResult FileResult) error {
+	if storedEncoding(fileResult) != "" {
+		return s.serveStoredEncoded(c, fileResult)
+	}
+	if sidecar, encoding, ok := s.findPrecompressed(c, fileResult); ok {
+		return s.servePrecompressed(c, fileResult, sidecar, encoding)
+	}
+
+	encodings, identity := s.selectEncodings(c, fileResult)
+	var encoding string
+	if len(encodings) > 0 {
+		encoding = encodings[0]
+	}
+	header := c.Response().Header()
+	header.Set("Accept-Ranges", "bytes")
+	if s.negotiatesEncoding(fileResult) || s.looksUpPrecompressed(fileResult) {
+		header.Add("Vary", "Accept-Encoding")
+	}
+	if encoding == "" && !identity {
+		return c.NoContent(http.StatusNotAcceptable)
+	}
+	etag := entityTag(fileResult.Attrs, encoding)
+	if etag != "" {
+		header.Set("ETag", etag)
+	}
+	var modtime time.Time
+	if fileResult.Attrs != nil {
+		modtime = fileResult.Attrs.Updated
+	}
+	if !modtime.IsZero() {
+		header.Set("Last-Modified", modtime.UTC().Format(http.TimeFormat))
+	}
+	if fileResult.Stale {
+		header.Set("X-Cache", "STALE")
+		header.Set("Warning", staleWarning)
+	}
+
+	if handled, err := s.checkPreconditions(c, etag, modtime); handled {
+		return err
+	}
+	if c.Request().Method == http.MethodHead {
+		return s.serveHead(c, fileResult, encoding)
+	}
+	if handled, err := s.serveRange(c, fileResult); handled {
+		return err
+	}
+
+	// A cached compressed representation is served without reading the file
+	if encoding != "" {
+		if compressed := s.cachedVariant(fileResult, encoding); compressed != nil {
+			header.Set("Content-Encoding", encoding)
+			header.Set("Content-Length", strconv.Itoa(len(compressed)))
+			return c.Blob(http.StatusOK, fileResult.ContentType, compressed)
 		}
+	}
 
-		c.Response().Header().Set("Content-Length", strconv.FormatInt(fileResult.Size, 10))
-		return c.Blob(http.StatusOK, fileResult.ContentType, fileResult.Body)
+	if err := s.openFile(c.Request().Context(), &fileResult, encodings); err != nil {
+		return backendError(err)
+	}
+	defer fileResult.Close()
+
+	// An encoding that fails falls back to the next acceptable one. Buffered
+	// files are compressed at once, the others while they are streamed.
+	for _, encoding := range encodings {
+		var compressor io.WriteCloser
+		var compressed []byte
+		var err error
+		if fileResult.Reader != nil {
+			compressor, err = s.newCompressor(c.Response(), encoding)
+		} else {
+			compressed, err = s.compressFile(fileResult, encoding)
+		}
+		if err != nil {
+			continue
+		}
+		if etag != "" {
+			header.Set("ETag", entityTag(fileResult.Attrs, encoding))
+		}
+		header.Set("Content-Encoding", encoding)
+		if compressor != nil {
+			return s.streamCompressed(c, fileResult, compressor)
+		}
+		header.Set("Content-Length", strconv.Itoa(len(compressed)))
+		return c.Blob(http.StatusOK, fileResult.ContentType, compressed)
+	}
+	if !identity {
+		header.Del("ETag")
+		return c.NoContent(http.StatusNotAcceptable)
 	}
+	// The file is sent as is, so it must carry the ETag of the identity representation
+	if etag != "" && encoding != "" {
+		header.Set("ETag", entityTag(fileResult.Attrs, ""))
+	}
+
+	// Files that are not buffered are streamed as they are
+	if fileResult.Reader != nil {
+		return s.streamFile(c, fileResult)
+	}
+	header.Set("Content-Length", strconv.FormatInt(fileResult.Size, 10))
+	return c.Blob(http.StatusOK, fileResult.ContentType, fileResult.Body)
+}
+
+// streamFile copies the reader of a file that was not buffered straight to the response
+func (s *FilesStore) streamFile(c echo.Context, result FileResult) error {
+	c.Response().Header().Set("Content-Length", strconv.FormatInt(result.Size, 10))
+	return c.Stream(http.StatusOK, result.ContentType, result.Reader)
+}
+
+// streamCompressed compresses the reader of a file that was not buffered while it
+// is copied to the response. The compressed length is not known up front, so no
+// Content-Length is sent and the response uses chunked transfer encoding.
+func (s *FilesStore) streamCompressed(c echo.Context, result FileResult, compressor io.WriteCloser) error {
+	c.Response().Header().Set(echo.HeaderContentType, result.ContentType)
+	c.Response().WriteHeader(http.StatusOK)
+	if _, err := io.Copy(compressor, result.Reader); err != nil {
+		return err
+	}
+	return compressor.Close()
+}
+
+// serveHead answers a HEAD request with the headers a GET request would receive,
+// using only the file attributes so that no content is read from the backend.
+// The length of a compressed representation is not known without compressing
+// the content, so for compressed responses Content-Length is only sent when the
+// compressed representation is cached.
+func (s *FilesStore) serveHead(c echo.Context, result FileResult, encoding string) error {
+	header := c.Response().Header()
+	header.Set("Content-Type", result.ContentType)
+	if encoding == "" {
+		header.Set("Content-Length", strconv.FormatInt(result.Size, 10))
+		return c.NoContent(http.StatusOK)
+	}
+	header.Set("Content-Encoding", encoding)
+	if compressed := s.cachedVariant(result, encoding); compressed != nil {
+		header.Set("Content-Length", strconv.Itoa(len(compressed)))
+	}
+	return c.NoContent(http.StatusOK)
 }
 
 // filePath processes the request URL path according to the configuration settings.
@@ -157,15 +497,7 @@ func (s *FilesStore) ServerHeader(next echo.HandlerFunc) echo.HandlerFunc {
 // Returns:
 //   - string representing the processed file path to be used for GCS object retrieval
 func (s *FilesStore) filePath(ctx echo.Context) string {
-	reqPath := ctx.Request().URL.Path
-	rootPath := s.config.RootPath
-	if rootPath[0] != '/' {
-		rootPath = "/" + rootPath
-	}
-	if rootPath[len(rootPath)-1:] != "/" {
-		rootPath = rootPath + "/"
-	}
-	reqPath = strings.Replace(reqPath, rootPath, "", 1)
+	reqPath := s.relativePath(ctx)
 	if s.config.IsSPA {
 		base := path.Base(reqPath)
 		if !strings.Contains(base, ".") {
@@ -182,24 +514,40 @@ func (s *FilesStore) filePath(ctx echo.Context) string {
 	return reqPath
 }
 
+// relativePath returns the request URL path with the root path removed
+func (s *FilesStore) relativePath(ctx echo.Context) string {
+	reqPath := ctx.Request().URL.Path
+	rootPath := s.config.RootPath
+	if rootPath == "" {
+		rootPath = "/"
+	}
+	if rootPath[0] != '/' {
+		rootPath = "/" + rootPath
+	}
+	if rootPath[len(rootPath)-1:] != "/" {
+		rootPath = rootPath + "/"
+	}
+	return strings.Replace(reqPath, rootPath, "", 1)
+}
+
 // mimeTypeMap contains common file extensions and their corresponding MIME types
 var mimeTypeMap = map[string]string{
-	".html": "text/html",
-	".css":  "text/css",
-	".js":   "application/javascript",
-	".json": "application/json",
-	".png":  "image/png",
-	".jpg":  "image/jpeg",
-	".jpeg": "image/jpeg",
-	".gif":  "image/gif",
-	".svg":  "image/svg+xml",
-	".ico":  "image/x-icon",
-	".txt":  "text/plain",
-	".pdf":  "application/pdf",
-	".woff": "font/woff",
+	".html":  "text/html",
+	".css":   "text/css",
+	".js":    "application/javascript",
+	".json":  "application/json",
+	".png":   "image/png",
+	".jpg":   "image/jpeg",
+	".jpeg":  "image/jpeg",
+	".gif":   "image/gif",
+	".svg":   "image/svg+xml",
+	".ico":   "image/x-icon",
+	".txt":   "text/plain",
+	".pdf":   "application/pdf",
+	".woff":  "font/woff",
 	".woff2": "font/woff2",
-	".ttf":  "font/ttf",
-	".eot":  "application/vnd.ms-fontobject",
+	".ttf":   "font/ttf",
+	".eot":   "application/vnd.ms-fontobject",
 }
 
 // getContentType determines the content type of a file based on its extension
@@ -235,100 +583,215 @@ func getContentType(filePath string, fallback string) string {
 	return "application/octet-stream"
 }
 
-// FileResult represents the result of a file retrieval operation
+// FileResult represents the result of a file retrieval operation.
+// getFile only fills in the attributes of the file. Its contents are loaded by
+// openFile: files that are going to be compressed are buffered into Body, while all other
+// files are returned as an open Reader so they can be streamed to the client.
 type FileResult struct {
+	Path        string
+	Attrs       *ObjectAttrs
 	Body        []byte
+	Reader      io.ReadCloser
 	ContentType string
 	Size        int64
 	Err         error
+
+	// Stale reports whether the attributes are no longer current, because they
+	// were served from the cache while being revalidated or while the backend failed
+	Stale bool
 }
 
-// getFile retrieves a file from Google Cloud Storage using the specified path.
-// It handles the GCS object reading and returns the file contents along with
-// the content type and size.
+// Close closes the Reader of a streamed file, if any
+func (r FileResult) Close() error {
+	if r.Reader == nil {
+		return nil
+	}
+	return r.Reader.Close()
+}
+
+// generation returns the generation of the file whose attributes were retrieved,
+// or zero if it is not known
+func (r FileResult) generation() int64 {
+	if r.Attrs == nil {
+		return 0
+	}
+	return r.Attrs.Generation
+}
+
+// getFile retrieves the attributes of a file from the storage backend using the
+// specified path. The contents are not read until openFile is called, so a file
+// that is not going to be served costs only a metadata lookup.
 //
 // Parameters:
-//   - path: The path to the file in the GCS bucket
+//   - ctx: The context of the request, bounded by StatTimeout for the lookup
+//   - path: The path to the file in the bucket
 //
 // Returns:
-//   - body: The file contents as a byte slice
-//   - contentType: The MIME type of the file
-//   - size: The size of the file in bytes
-//   - err: Any error encountered during the file retrieval process
-func (s *FilesStore) getFile(path string) (body []byte, contentType string, size int64, err error) {
-	obj := s.config.Client.Bucket(s.config.BucketName).Object(path)
-	attrs, err := obj.Attrs(context.Background())
+//   - FileResult containing the attributes, content type and size of the file,
+//     or any error encountered during the file retrieval process
+func (s *FilesStore) getFile(ctx context.Context, path string) FileResult {
+	ctx, cancel := withTimeout(ctx, s.config.StatTimeout)
+	defer cancel()
+
+	attrs, stale, err := statStale(ctx, s.backend, path)
 	if err != nil {
-		return nil, "", 0, err
+		return FileResult{Path: path, Err: err}
 	}
 
-	reader, err := obj.NewReader(context.Background())
+	// Get content type from file extension first, falling back to the stored metadata
+	return FileResult{
+		Path:        path,
+		Attrs:       attrs,
+		ContentType: getContentType(path, attrs.ContentType),
+		Size:        attrs.Size,
+		Stale:       stale,
+	}
+}
+
+// openFile loads the contents of a file retrieved by getFile, reading the same
+// generation the attributes describe if the backend supports it. The contents are only
+// buffered when the file is going to be compressed with one of the negotiated
+// encodings and is not larger than StreamThreshold. Otherwise result.Reader is set
+// and the caller must close it. The whole read, including streaming, is bounded by
+// ReadTimeout.
+func (s *FilesStore) openFile(ctx context.Context, result *FileResult, encodings []string) error {
+	reader, err := s.openReader(ctx, func(ctx context.Context) (io.ReadCloser, error) {
+		return openGeneration(ctx, s.backend, result.Path, result.generation())
+	})
 	if err != nil {
-		return nil, "", 0, err
+		return err
+	}
+
+	if result.Size > s.streamThreshold() || len(encodings) == 0 {
+		result.Reader = reader
+		return nil
 	}
 	defer reader.Close()
 
-	fileBinary, err := io.ReadAll(reader)
+	result.Body, err = io.ReadAll(reader)
+	return err
+}
+
+// openReader opens a reader with open under a context bounded by ReadTimeout.
+// The context is only released once the reader is closed, so that the deadline
+// also covers the time spent reading from it.
+func (s *FilesStore) openReader(ctx context.Context, open func(context.Context) (io.ReadCloser, error)) (io.ReadCloser, error) {
+	ctx, cancel := withTimeout(ctx, s.config.ReadTimeout)
+	reader, err := open(ctx)
 	if err != nil {
-		return nil, "", 0, err
+		cancel()
+		return nil, err
 	}
-
-	// Get content type from file extension first, falling back to GCS metadata
-	contentType = getContentType(path, attrs.ContentType)
-	return fileBinary, contentType, attrs.Size, nil
+	return cancelReadCloser{ReadCloser: reader, cancel: cancel}, nil
 }
 
-// getFileAsync retrieves a file from GCS asynchronously
-func (s *FilesStore) getFileAsync(path string, resultChan chan<- FileResult) {
-	body, contentType, size, err := s.getFile(path)
-	resultChan <- FileResult{
-		Body:        body,
-		ContentType: contentType,
-		Size:        size,
-		Err:         err,
+// withTimeout returns a copy of ctx that is cancelled after timeout, or ctx
+// itself if timeout is not positive
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return ctx, func() {}
 	}
+	return context.WithTimeout(ctx, timeout)
 }
 
-// getFiles retrieves multiple files from GCS in parallel
-func (s *FilesStore) getFiles(paths []string) []FileResult {
-	resultChan := make(chan FileResult, len(paths))
-	results := make([]FileResult, len(paths))
+// cancelReadCloser releases the context of a reader once it is closed
+type cancelReadCloser struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
 
-	// Start goroutines for each file
-	for _, path := range paths {
-		go s.getFileAsync(path, resultChan)
+func (r cancelReadCloser) Close() error {
+	err := r.ReadCloser.Close()
+	r.cancel()
+	return err
+}
+
+// streamThreshold returns the size above which files are never buffered in memory
+func (s *FilesStore) streamThreshold() int64 {
+	if s.config.StreamThreshold == 0 {
+		return defaultStreamThreshold
 	}
+	return s.config.StreamThreshold
+}
 
-	// Collect results
-	for i := 0; i < len(paths); i++ {
-		result := <-resultChan
-		results[i] = result
+// compressionLevel returns the level files are compressed with using the encoding
+func (s *FilesStore) compressionLevel(encoding string) int {
+	level, defaultLevel := s.config.CompressionLevel, 6
+	switch encoding {
+	case "br":
+		level, defaultLevel = s.config.BrotliLevel, 6
+	case "zstd":
+		level, defaultLevel = s.config.ZstdLevel, 3
+	}
+	if level == 0 {
+		return defaultLevel
 	}
+	return level
+}
 
-	return results
+// variantKey returns the cache key of the file and whether its compressed
+// representations can be cached at all
+func (s *FilesStore) variantKey(result FileResult) (objectKey, int64, bool) {
+	if s.config.Cache == nil || result.Attrs == nil {
+		return objectKey{}, 0, false
+	}
+	return objectKey{bucket: s.config.BucketName, name: result.Path}, result.Attrs.Generation, true
 }
 
-// compressData compresses the input data using the specified encoding
-func (s *FilesStore) compressData(data []byte, encoding string) ([]byte, error) {
-	var buf bytes.Buffer
-	var writer io.WriteCloser
+// cachedVariant returns the cached compressed representation of the file, or nil
+// if there is none
+func (s *FilesStore) cachedVariant(result FileResult, encoding string) []byte {
+	obj, generation, ok := s.variantKey(result)
+	if !ok {
+		return nil
+	}
+	return s.config.Cache.getVariant(obj, generation, encoding, s.compressionLevel(encoding))
+}
+
+// compressFile compresses the buffered contents of the file and caches the
+// compressed representation along with the file, so that it is compressed only
+// once per generation, encoding and level
+func (s *FilesStore) compressFile(result FileResult, encoding string) ([]byte, error) {
+	compressed, err := s.compressData(result.Body, encoding)
+	if err != nil {
+		return nil, err
+	}
+	if obj, generation, ok := s.variantKey(result); ok {
+		s.config.Cache.putVariant(obj, generation, encoding, s.compressionLevel(encoding), compressed)
+	}
+	return compressed, nil
+}
 
+// newCompressor returns a writer that compresses what is written to it with the
+// specified encoding into w. Nothing is written to w until the writer is used.
+func (s *FilesStore) newCompressor(w io.Writer, encoding string) (io.WriteCloser, error) {
+	level := s.compressionLevel(encoding)
 	switch encoding {
 	case "gzip":
-		level := s.config.CompressionLevel
-		if level == 0 {
-			level = 6 // default compression level
-		}
-		writer, _ = gzip.NewWriterLevel(&buf, level)
+		return gzip.NewWriterLevel(w, level)
 	case "br":
-		// Note: brotli compression requires additional dependency
-		// You may want to add github.com/andybalholm/brotli
-		return nil, fmt.Errorf("brotli compression not implemented")
+		if level < brotli.BestSpeed || level > brotli.BestCompression {
+			return nil, fmt.Errorf("invalid brotli compression level: %d", level)
+		}
+		return brotli.NewWriterLevel(w, level), nil
+	case "zstd":
+		return zstd.NewWriter(w,
+			zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)),
+			zstd.WithEncoderConcurrency(1))
 	default:
 		return nil, fmt.Errorf("unsupported encoding: %s", encoding)
 	}
+}
 
-	_, err := writer.Write(data)
+// compressData compresses the input data using the specified encoding
+func (s *FilesStore) compressData(data []byte, encoding string) ([]byte, error) {
+	var buf bytes.Buffer
+	writer, err := s.newCompressor(&buf, encoding)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = writer.Write(data)
 	if err != nil {
 		return nil, err
 	}
@@ -341,6 +804,15 @@ func (s *FilesStore) compressData(data []byte, encoding string) ([]byte, error)
 	return buf.Bytes(), nil
 }
 
+// negotiatesEncoding reports whether the encoding of the file depends on the
+// Accept-Encoding header of the request
+func (s *FilesStore) negotiatesEncoding(result FileResult) bool {
+	if !s.shouldCompress(result.ContentType, result.Size) {
+		return false
+	}
+	return result.Size <= s.streamThreshold() || s.config.StreamCompression
+}
+
 // shouldCompress determines if the file should be compressed based on its content type and size
 func (s *FilesStore) shouldCompress(contentType string, size int64) bool {
 	if !s.config.EnableCompression {
@@ -351,17 +823,18 @@ func (s *FilesStore) shouldCompress(contentType string, size int64) bool {
 		return false
 	}
 
-	compressibleTypes := map[string]bool{
-		"text/html":                true,
-		"text/css":                 true,
-		"text/plain":               true,
-		"text/xml":                 true,
-		"application/javascript":    true,
-		"application/json":         true,
-		"application/xml":          true,
-		"application/x-javascript": true,
-		"application/ld+json":      true,
-	}
-
 	return compressibleTypes[contentType]
 }
+
+// compressibleTypes lists the content types that are worth compressing
+var compressibleTypes = map[string]bool{
+	"text/html":                true,
+	"text/css":                 true,
+	"text/plain":               true,
+	"text/xml":                 true,
+	"application/javascript":   true,
+	"application/json":         true,
+	"application/xml":          true,
+	"application/x-javascript": true,
+	"application/ld+json":      true,
+}
@@ -3,13 +3,20 @@ package gcsmiddleware
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
 	"github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/assert"
 )
@@ -238,7 +245,7 @@ func TestGetContentType(t *testing.T) {
 func TestShouldCompress(t *testing.T) {
 	fs := &FilesStore{
 		config: GCSStaticConfig{
-			EnableCompression:      true,
+			EnableCompression:     true,
 			MinSizeForCompression: 1024, // 1KB
 		},
 	}
@@ -310,10 +317,16 @@ func TestCompressData(t *testing.T) {
 			wantErr:  false,
 		},
 		{
-			name:     "Brotli compression (not implemented)",
-			data:     []byte("Hello, World!"),
+			name:     "Brotli compression",
+			data:     []byte(strings.Repeat("Hello, World!", 100)),
 			encoding: "br",
-			wantErr:  true,
+			wantErr:  false,
+		},
+		{
+			name:     "Zstandard compression",
+			data:     []byte(strings.Repeat("Hello, World!", 100)),
+			encoding: "zstd",
+			wantErr:  false,
 		},
 		{
 			name:     "Invalid encoding",
@@ -333,17 +346,48 @@ func TestCompressData(t *testing.T) {
 				assert.NotNil(t, compressed)
 				// 圧縮データは元のデータより小さくなるはず
 				assert.Less(t, len(compressed), len(tt.data))
+				assert.Equal(t, tt.data, decompress(t, tt.encoding, compressed))
 			}
 		})
 	}
 }
 
+// decompress decodes data compressed with the given content encoding
+func decompress(t *testing.T, encoding string, data []byte) []byte {
+	t.Helper()
+	var reader io.Reader
+	switch encoding {
+	case "gzip":
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = gz
+	case "br":
+		reader = brotli.NewReader(bytes.NewReader(data))
+	case "zstd":
+		zr, err := zstd.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer zr.Close()
+		reader = zr
+	default:
+		t.Fatalf("unsupported encoding: %s", encoding)
+	}
+	decompressed, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decompressed
+}
+
 // TestContentLength tests the content length calculation
 func TestContentLength(t *testing.T) {
 	fs := &FilesStore{
 		config: GCSStaticConfig{
 			EnableCompression: true,
-			CompressionLevel: 6,
+			CompressionLevel:  6,
 		},
 	}
 
@@ -395,14 +439,773 @@ func TestContentLength(t *testing.T) {
 	}
 }
 
-// TestGetFiles tests parallel file retrieval functionality
-func TestGetFiles(t *testing.T) {
-	t.Skip("Skipping test that requires GCS credentials")
+// memoryBackend is a Backend that serves objects from memory, used to test
+// the middleware without GCS credentials
+type memoryBackend map[string][]byte
+
+func (b memoryBackend) Stat(_ context.Context, name string) (*ObjectAttrs, error) {
+	data, ok := b[name]
+	if !ok {
+		return nil, ErrObjectNotExist
+	}
+	return &ObjectAttrs{Name: name, Size: int64(len(data))}, nil
+}
+
+func (b memoryBackend) Open(_ context.Context, name string) (io.ReadCloser, error) {
+	data, ok := b[name]
+	if !ok {
+		return nil, ErrObjectNotExist
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (b memoryBackend) List(_ context.Context, prefix string) ([]*ObjectAttrs, error) {
+	var objects []*ObjectAttrs
+	for name, data := range b {
+		if strings.HasPrefix(name, prefix) {
+			objects = append(objects, &ObjectAttrs{Name: name, Size: int64(len(data))})
+		}
+	}
+	return objects, nil
+}
+
+// serve runs a request through the middleware built from config and returns the recorded response
+func serve(config GCSStaticConfig, req *http.Request) *httptest.ResponseRecorder {
+	e := echo.New()
+	rec := httptest.NewRecorder()
+	ctx := e.NewContext(req, rec)
+	next := func(c echo.Context) error {
+		return c.String(http.StatusTeapot, "next")
+	}
+	if err := NewGCSStaticMiddleware(config).ServerHeader(next)(ctx); err != nil {
+		e.HTTPErrorHandler(err, ctx)
+	}
+	return rec
+}
+
+// TestGetFile tests retrieving the attributes of a file and opening it
+func TestGetFile(t *testing.T) {
+	fs := &FilesStore{
+		backend: memoryBackend{
+			"css/style.css": []byte("body{}"),
+		},
+	}
+
+	missing := fs.getFile(context.Background(), "missing.js")
+	assert.ErrorIs(t, missing.Err, ErrObjectNotExist)
+	assert.Equal(t, "missing.js", missing.Path)
+
+	result := fs.getFile(context.Background(), "css/style.css")
+	assert.NoError(t, result.Err)
+	// Only the attributes are retrieved until the file is opened
+	assert.Nil(t, result.Body)
+	assert.Nil(t, result.Reader)
+	assert.Equal(t, "css/style.css", result.Path)
+	assert.Equal(t, "text/css", result.ContentType)
+	assert.Equal(t, int64(6), result.Size)
+
+	// Compression is disabled, so the file is streamed rather than buffered
+	assert.NoError(t, fs.openFile(context.Background(), &result, nil))
+	assert.Nil(t, result.Body)
+	data, err := io.ReadAll(result.Reader)
+	assert.NoError(t, err)
+	assert.NoError(t, result.Close())
+	assert.Equal(t, []byte("body{}"), data)
 }
 
 // TestParallelSPAHandling tests the parallel handling of SPA mode
 func TestParallelSPAHandling(t *testing.T) {
-	t.Skip("Skipping test that requires GCS credentials")
+	backend := memoryBackend{
+		"index.html": []byte("<html>app</html>"),
+		"main.js":    []byte("console.log(1)"),
+	}
+
+	tests := []struct {
+		name        string
+		requestURL  string
+		isSPA       bool
+		wantStatus  int
+		wantBody    string
+		contentType string
+	}{
+		{
+			name:        "Existing asset",
+			requestURL:  "/main.js",
+			isSPA:       false,
+			wantStatus:  http.StatusOK,
+			wantBody:    "console.log(1)",
+			contentType: "application/javascript",
+		},
+		{
+			name:        "Existing asset in SPA mode",
+			requestURL:  "/main.js",
+			isSPA:       true,
+			wantStatus:  http.StatusOK,
+			wantBody:    "console.log(1)",
+			contentType: "application/javascript",
+		},
+		{
+			name:        "Client-side route falls back to index.html",
+			requestURL:  "/dashboard",
+			isSPA:       true,
+			wantStatus:  http.StatusOK,
+			wantBody:    "<html>app</html>",
+			contentType: "text/html",
+		},
+		{
+			name:       "Missing file without SPA",
+			requestURL: "/dashboard",
+			isSPA:      false,
+			wantStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := GCSStaticConfig{
+				Backend:  backend,
+				RootPath: "/",
+				IsSPA:    tt.isSPA,
+			}
+			rec := serve(config, httptest.NewRequest(http.MethodGet, tt.requestURL, nil))
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			if tt.wantStatus == http.StatusOK {
+				assert.Equal(t, tt.wantBody, rec.Body.String())
+				assert.Equal(t, tt.contentType, rec.Header().Get(echo.HeaderContentType))
+				assert.Equal(t, strconv.Itoa(len(tt.wantBody)), rec.Header().Get(echo.HeaderContentLength))
+			}
+		})
+	}
+}
+
+// TestServerHeaderIgnorePath tests that ignored paths are passed to the next handler
+func TestServerHeaderIgnorePath(t *testing.T) {
+	config := GCSStaticConfig{
+		Backend:    memoryBackend{"api/login": []byte("object")},
+		RootPath:   "/",
+		IgnorePath: []string{"/api/login"},
+	}
+	rec := serve(config, httptest.NewRequest(http.MethodGet, "/api/login", nil))
+
+	assert.Equal(t, http.StatusTeapot, rec.Code)
+	assert.Equal(t, "next", rec.Body.String())
+}
+
+// TestServerHeaderMethods tests that only GET and HEAD requests are served from the
+// backend and that other methods reach the Echo routes
+func TestServerHeaderMethods(t *testing.T) {
+	e := echo.New()
+	e.Use(NewGCSStaticMiddleware(GCSStaticConfig{
+		Backend: memoryBackend{
+			"index.html": []byte("<html>app</html>"),
+			"main.js":    []byte("console.log(1)"),
+		},
+		RootPath: "/",
+	}).ServerHeader)
+	e.POST("/api/login", func(c echo.Context) error {
+		return c.String(http.StatusOK, "logged in")
+	})
+
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		wantStatus int
+		wantBody   string
+		wantAllow  string
+	}{
+		{
+			name:       "GET serves the file",
+			method:     http.MethodGet,
+			target:     "/main.js",
+			wantStatus: http.StatusOK,
+			wantBody:   "console.log(1)",
+		},
+		{
+			name:       "POST reaches the route",
+			method:     http.MethodPost,
+			target:     "/api/login",
+			wantStatus: http.StatusOK,
+			wantBody:   "logged in",
+		},
+		{
+			name:       "POST to an unrouted path that is not a file",
+			method:     http.MethodPost,
+			target:     "/api/logout",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "POST to a file",
+			method:     http.MethodPost,
+			target:     "/main.js",
+			wantStatus: http.StatusMethodNotAllowed,
+			wantAllow:  "GET, HEAD, OPTIONS",
+		},
+		{
+			name:       "DELETE to a file",
+			method:     http.MethodDelete,
+			target:     "/main.js",
+			wantStatus: http.StatusMethodNotAllowed,
+			wantAllow:  "GET, HEAD, OPTIONS",
+		},
+		{
+			name:       "OPTIONS for a file",
+			method:     http.MethodOptions,
+			target:     "/main.js",
+			wantStatus: http.StatusNoContent,
+			wantAllow:  "GET, HEAD, OPTIONS",
+		},
+		{
+			name:       "OPTIONS for a route",
+			method:     http.MethodOptions,
+			target:     "/api/login",
+			wantStatus: http.StatusNoContent,
+			wantAllow:  "OPTIONS, POST",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.target, nil))
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			assert.Equal(t, tt.wantAllow, rec.Header().Get(echo.HeaderAllow))
+			if tt.wantBody != "" {
+				assert.Equal(t, tt.wantBody, rec.Body.String())
+			}
+		})
+	}
+}
+
+// TestServerHeaderFallThrough tests that missing files are passed to the Echo routes
+// when FallThrough is enabled
+func TestServerHeaderFallThrough(t *testing.T) {
+	newEcho := func(fallThrough, isSPA bool) *echo.Echo {
+		e := echo.New()
+		e.Use(NewGCSStaticMiddleware(GCSStaticConfig{
+			Backend: memoryBackend{
+				"main.js":    []byte("console.log(1)"),
+				"index.html": []byte("<html>app</html>"),
+			},
+			RootPath:    "/",
+			IsSPA:       isSPA,
+			FallThrough: fallThrough,
+		}).ServerHeader)
+		e.GET("/api/users", func(c echo.Context) error {
+			return c.String(http.StatusOK, "users")
+		})
+		e.GET("/main.js", func(c echo.Context) error {
+			return c.String(http.StatusOK, "route")
+		})
+		e.GET("/api/users/:id", func(c echo.Context) error {
+			return echo.NewHTTPError(http.StatusNotFound, "no such user")
+		})
+		return e
+	}
+
+	tests := []struct {
+		name        string
+		fallThrough bool
+		isSPA       bool
+		target      string
+		wantStatus  int
+		wantBody    string
+	}{
+		{
+			name:        "File takes precedence over the route",
+			fallThrough: true,
+			target:      "/main.js",
+			wantStatus:  http.StatusOK,
+			wantBody:    "console.log(1)",
+		},
+		{
+			name:        "Missing file reaches the route",
+			fallThrough: true,
+			target:      "/api/users",
+			wantStatus:  http.StatusOK,
+			wantBody:    "users",
+		},
+		{
+			name:        "Missing file and route",
+			fallThrough: true,
+			target:      "/api/groups",
+			wantStatus:  http.StatusNotFound,
+		},
+		{
+			name:        "Missing file without FallThrough",
+			fallThrough: false,
+			target:      "/api/users",
+			wantStatus:  http.StatusNotFound,
+		},
+		{
+			name:        "SPA file takes precedence over the route",
+			fallThrough: true,
+			isSPA:       true,
+			target:      "/main.js",
+			wantStatus:  http.StatusOK,
+			wantBody:    "console.log(1)",
+		},
+		{
+			name:        "SPA route takes precedence over index.html",
+			fallThrough: true,
+			isSPA:       true,
+			target:      "/api/users",
+			wantStatus:  http.StatusOK,
+			wantBody:    "users",
+		},
+		{
+			name:        "SPA keeps the 404 of a matched route",
+			fallThrough: true,
+			isSPA:       true,
+			target:      "/api/users/42",
+			wantStatus:  http.StatusNotFound,
+			wantBody:    `{"message":"no such user"}` + "\n",
+		},
+		{
+			name:        "SPA falls back to index.html when no route matched",
+			fallThrough: true,
+			isSPA:       true,
+			target:      "/dashboard",
+			wantStatus:  http.StatusOK,
+			wantBody:    "<html>app</html>",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			newEcho(tt.fallThrough, tt.isSPA).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.target, nil))
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			if tt.wantBody != "" {
+				assert.Equal(t, tt.wantBody, rec.Body.String())
+			}
+		})
+	}
+}
+
+// TestServerHeaderSkip tests the Skipper and the ignored path matchers
+func TestServerHeaderSkip(t *testing.T) {
+	config := GCSStaticConfig{
+		Backend:          memoryBackend{},
+		RootPath:         "/",
+		IgnorePath:       []string{"/healthz"},
+		IgnorePathPrefix: []string{"/api/"},
+		IgnorePathGlob:   []string{"/internal/*.json"},
+		IgnorePathRegexp: []*regexp.Regexp{regexp.MustCompile(`^/v[0-9]+/`)},
+		Skipper: func(c echo.Context) bool {
+			return c.Request().Header.Get("X-Skip") != ""
+		},
+	}
+
+	tests := []struct {
+		name     string
+		target   string
+		skipper  bool
+		wantNext bool
+	}{
+		{name: "Exact path", target: "/healthz", wantNext: true},
+		{name: "Exact path with query", target: "/healthz?probe", wantNext: true},
+		{name: "Exact path does not match subpaths", target: "/healthz/live", wantNext: false},
+		{name: "Prefix", target: "/api/users/42", wantNext: true},
+		{name: "Prefix requires the full segment", target: "/apidocs", wantNext: false},
+		{name: "Glob", target: "/internal/status.json", wantNext: true},
+		{name: "Glob does not cross slashes", target: "/internal/a/status.json", wantNext: false},
+		{name: "Regexp", target: "/v2/items", wantNext: true},
+		{name: "Skipper", target: "/index.html", skipper: true, wantNext: true},
+		{name: "Not ignored", target: "/index.html", wantNext: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.skipper {
+				req.Header.Set("X-Skip", "1")
+			}
+			rec := serve(config, req)
+
+			if tt.wantNext {
+				assert.Equal(t, http.StatusTeapot, rec.Code)
+			} else {
+				assert.Equal(t, http.StatusNotFound, rec.Code)
+			}
+		})
+	}
+}
+
+// TestNewGCSStaticMiddlewareBadGlob tests that malformed IgnorePathGlob patterns
+// are reported when the middleware is created
+func TestNewGCSStaticMiddlewareBadGlob(t *testing.T) {
+	for _, pattern := range []string{"/internal/[", "/assets/*.js\\", "/a/[]"} {
+		t.Run(pattern, func(t *testing.T) {
+			assert.Panics(t, func() {
+				NewGCSStaticMiddleware(GCSStaticConfig{
+					Backend:        memoryBackend{},
+					RootPath:       "/",
+					IgnorePathGlob: []string{"/healthz", pattern},
+				})
+			})
+		})
+	}
+}
+
+// TestServerHeaderCompression tests that compressible files are served gzip-encoded
+func TestServerHeaderCompression(t *testing.T) {
+	body := strings.Repeat("Hello, World!", 100)
+	config := GCSStaticConfig{
+		Backend:           memoryBackend{"index.html": []byte(body)},
+		RootPath:          "/",
+		EnableCompression: true,
+		CompressionLevel:  6,
+	}
+	req := httptest.NewRequest(http.MethodGet, "/index.html", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := serve(config, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "gzip", rec.Header().Get(echo.HeaderContentEncoding))
+	assert.Equal(t, strconv.Itoa(rec.Body.Len()), rec.Header().Get(echo.HeaderContentLength))
+
+	gz, err := gzip.NewReader(rec.Body)
+	assert.NoError(t, err)
+	decompressed, err := io.ReadAll(gz)
+	assert.NoError(t, err)
+	assert.Equal(t, body, string(decompressed))
+}
+
+// TestServerHeaderCompressionEncodings tests choosing between brotli, zstd and gzip
+// and falling back to the next acceptable encoding when one fails
+func TestServerHeaderCompressionEncodings(t *testing.T) {
+	body := strings.Repeat("Hello, World!", 100)
+	backend := attrsBackend{
+		memoryBackend: memoryBackend{"index.html": []byte(body)},
+		attrs:         ObjectAttrs{MD5: []byte{0x01, 0x02, 0x03}},
+	}
+
+	tests := []struct {
+		name           string
+		brotliLevel    int
+		acceptEncoding string
+		wantEncoding   string
+	}{
+		{
+			name:           "Brotli is preferred",
+			acceptEncoding: "gzip, deflate, br, zstd",
+			wantEncoding:   "br",
+		},
+		{
+			name:           "Zstandard",
+			acceptEncoding: "gzip, zstd",
+			wantEncoding:   "zstd",
+		},
+		{
+			name:           "Gzip",
+			acceptEncoding: "gzip, deflate",
+			wantEncoding:   "gzip",
+		},
+		{
+			name:           "Failing encoding falls back to the next one",
+			brotliLevel:    20,
+			acceptEncoding: "gzip, br",
+			wantEncoding:   "gzip",
+		},
+		{
+			name:           "Failing encoding falls back to identity",
+			brotliLevel:    20,
+			acceptEncoding: "br",
+			wantEncoding:   "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := GCSStaticConfig{
+				Backend:           backend,
+				RootPath:          "/",
+				EnableCompression: true,
+				BrotliLevel:       tt.brotliLevel,
+			}
+			req := httptest.NewRequest(http.MethodGet, "/index.html", nil)
+			req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			rec := serve(config, req)
+
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, tt.wantEncoding, rec.Header().Get(echo.HeaderContentEncoding))
+			assert.Equal(t, strconv.Itoa(rec.Body.Len()), rec.Header().Get(echo.HeaderContentLength))
+			if tt.wantEncoding == "" {
+				assert.Equal(t, `"010203"`, rec.Header().Get("ETag"))
+				assert.Equal(t, body, rec.Body.String())
+				return
+			}
+			assert.Equal(t, `"010203-`+tt.wantEncoding+`"`, rec.Header().Get("ETag"))
+			assert.Equal(t, body, string(decompress(t, tt.wantEncoding, rec.Body.Bytes())))
+		})
+	}
+}
+
+// TestServerHeaderStreaming tests that files above StreamThreshold are streamed
+// uncompressed instead of being buffered
+func TestServerHeaderStreaming(t *testing.T) {
+	body := strings.Repeat("Hello, World!", 100)
+	fs := &FilesStore{
+		config: GCSStaticConfig{
+			RootPath:          "/",
+			EnableCompression: true,
+			StreamThreshold:   1024,
+		},
+		backend: memoryBackend{
+			"small.txt": []byte(body[:512]),
+			"large.txt": []byte(body),
+		},
+	}
+
+	small := fs.getFile(context.Background(), "small.txt")
+	assert.NoError(t, small.Err)
+	assert.NoError(t, fs.openFile(context.Background(), &small, []string{"gzip"}))
+	assert.Nil(t, small.Reader)
+	assert.Len(t, small.Body, 512)
+
+	// A file that is not going to be compressed is streamed whatever its size
+	identity := fs.getFile(context.Background(), "small.txt")
+	assert.NoError(t, fs.openFile(context.Background(), &identity, nil))
+	assert.Nil(t, identity.Body)
+	assert.NotNil(t, identity.Reader)
+	assert.NoError(t, identity.Close())
+
+	large := fs.getFile(context.Background(), "large.txt")
+	assert.NoError(t, large.Err)
+	assert.NoError(t, fs.openFile(context.Background(), &large, []string{"gzip"}))
+	assert.Nil(t, large.Body)
+	assert.NotNil(t, large.Reader)
+	assert.NoError(t, large.Close())
+
+	config := fs.config
+	config.Backend = fs.backend
+	req := httptest.NewRequest(http.MethodGet, "/large.txt", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := serve(config, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, rec.Header().Get(echo.HeaderContentEncoding))
+	assert.Equal(t, "text/plain", rec.Header().Get(echo.HeaderContentType))
+	assert.Equal(t, strconv.Itoa(len(body)), rec.Header().Get(echo.HeaderContentLength))
+	assert.Equal(t, body, rec.Body.String())
+}
+
+// TestServerHeaderStreamCompression tests that files above StreamThreshold are
+// compressed while they are streamed when StreamCompression is set
+func TestServerHeaderStreamCompression(t *testing.T) {
+	var lines []string
+	for i := 0; i < 20000; i++ {
+		lines = append(lines, fmt.Sprintf(`{"id":%d,"name":"item %d"}`, i, i*7919))
+	}
+	body := "[" + strings.Join(lines, ",") + "]"
+	small := body[:512]
+
+	e := echo.New()
+	e.Use(NewGCSStaticMiddleware(GCSStaticConfig{
+		Backend:           memoryBackend{"large.json": []byte(body), "small.json": []byte(small)},
+		RootPath:          "/",
+		EnableCompression: true,
+		StreamThreshold:   1024,
+		StreamCompression: true,
+	}).ServerHeader)
+	server := httptest.NewServer(e)
+	defer server.Close()
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+	for _, encoding := range []string{"gzip", "br", "zstd"} {
+		t.Run(encoding, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, server.URL+"/large.json", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Accept-Encoding", encoding)
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			compressed, err := io.ReadAll(resp.Body)
+			assert.NoError(t, err)
+
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, encoding, resp.Header.Get(echo.HeaderContentEncoding))
+			assert.Equal(t, "application/json", resp.Header.Get(echo.HeaderContentType))
+			assert.Equal(t, int64(-1), resp.ContentLength)
+			assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+			assert.Equal(t, body, string(decompress(t, encoding, compressed)))
+		})
+	}
+
+	// Small files keep the buffered path with an exact length
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/small.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	compressed, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "gzip", resp.Header.Get(echo.HeaderContentEncoding))
+	assert.Equal(t, int64(len(compressed)), resp.ContentLength)
+	assert.Equal(t, small, string(decompress(t, "gzip", compressed)))
+}
+
+// TestServerHeaderHead tests that HEAD requests get the headers of a GET request
+// without any content being read from the backend
+func TestServerHeaderHead(t *testing.T) {
+	body := strings.Repeat("Hello, World!", 100)
+	backend := &countingBackend{
+		Backend: attrsBackend{
+			memoryBackend: memoryBackend{"index.html": []byte(body)},
+			attrs: ObjectAttrs{
+				MD5:     []byte{0x0f},
+				Updated: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+			},
+		},
+	}
+	config := GCSStaticConfig{
+		Backend:           backend,
+		RootPath:          "/",
+		EnableCompression: true,
+	}
+
+	for _, acceptEncoding := range []string{"", "gzip"} {
+		t.Run("Accept-Encoding "+acceptEncoding, func(t *testing.T) {
+			newRequest := func(method string) *http.Request {
+				req := httptest.NewRequest(method, "/index.html", nil)
+				req.Header.Set("Accept-Encoding", acceptEncoding)
+				return req
+			}
+			get := serve(config, newRequest(http.MethodGet))
+
+			backend.opens.Store(0)
+			head := serve(config, newRequest(http.MethodHead))
+
+			assert.Equal(t, http.StatusOK, head.Code)
+			assert.Zero(t, backend.opens.Load())
+			assert.Zero(t, head.Body.Len())
+			for _, h := range []string{"Content-Type", "Content-Encoding", "ETag", "Last-Modified", "Vary", "Accept-Ranges"} {
+				assert.Equal(t, get.Header().Get(h), head.Header().Get(h), h)
+			}
+			if acceptEncoding == "" {
+				assert.Equal(t, get.Header().Get("Content-Length"), head.Header().Get("Content-Length"))
+			} else {
+				// The compressed length is unknown without compressing the content
+				assert.Empty(t, head.Header().Get("Content-Length"))
+			}
+		})
+	}
+}
+
+// blockingBackend is a memoryBackend whose lookups of the blocked objects, and reads
+// of all objects, only return once their context is done. It records the context
+// errors it saw.
+type blockingBackend struct {
+	memoryBackend
+	blocked map[string]bool
+	errs    chan error
+}
+
+func (b blockingBackend) Stat(ctx context.Context, name string) (*ObjectAttrs, error) {
+	if !b.blocked[name] {
+		return b.memoryBackend.Stat(ctx, name)
+	}
+	<-ctx.Done()
+	b.errs <- ctx.Err()
+	return nil, ctx.Err()
+}
+
+func (b blockingBackend) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	if _, err := b.memoryBackend.Stat(ctx, name); err != nil {
+		return nil, err
+	}
+	return io.NopCloser(blockingReader{ctx}), nil
+}
+
+// blockingReader is a reader that blocks until its context is done
+type blockingReader struct {
+	ctx context.Context
+}
+
+func (r blockingReader) Read([]byte) (int, error) {
+	<-r.ctx.Done()
+	return 0, r.ctx.Err()
+}
+
+// TestServerHeaderTimeouts tests that StatTimeout and ReadTimeout bound backend calls
+func TestServerHeaderTimeouts(t *testing.T) {
+	backend := blockingBackend{
+		memoryBackend: memoryBackend{"slow.txt": []byte("slow"), "app.js": []byte("app")},
+		blocked:       map[string]bool{"slow.txt": true},
+		errs:          make(chan error, 1),
+	}
+	config := GCSStaticConfig{
+		Backend:     backend,
+		RootPath:    "/",
+		StatTimeout: 20 * time.Millisecond,
+		ReadTimeout: 20 * time.Millisecond,
+	}
+
+	rec := serve(config, httptest.NewRequest(http.MethodGet, "/slow.txt", nil))
+	assert.Equal(t, http.StatusGatewayTimeout, rec.Code)
+	assert.ErrorIs(t, <-backend.errs, context.DeadlineExceeded)
+
+	fs := &FilesStore{config: config, backend: backend}
+	result := fs.getFile(context.Background(), "app.js")
+	assert.NoError(t, result.Err)
+	assert.NoError(t, fs.openFile(context.Background(), &result, nil))
+	_, err := io.ReadAll(result.Reader)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.NoError(t, result.Close())
+}
+
+// TestServerHeaderCancel tests that cancelling the request cancels every lookup,
+// including the speculative index.html lookup in SPA mode
+func TestServerHeaderCancel(t *testing.T) {
+	backend := blockingBackend{
+		memoryBackend: memoryBackend{},
+		blocked:       map[string]bool{"main.js": true, "index.html": true},
+		errs:          make(chan error, 2),
+	}
+	config := GCSStaticConfig{
+		Backend:           backend,
+		RootPath:          "/",
+		IsSPA:             true,
+		PrefetchFallbacks: true,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodGet, "/main.js", nil).WithContext(ctx)
+	done := make(chan error, 1)
+	go func() {
+		e := echo.New()
+		c := e.NewContext(req, httptest.NewRecorder())
+		done <- NewGCSStaticMiddleware(config).ServerHeader(func(c echo.Context) error {
+			return c.String(http.StatusTeapot, "next")
+		})(c)
+	}()
+	cancel()
+
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, context.Canceled)
+		var he *echo.HTTPError
+		if assert.ErrorAs(t, err, &he) {
+			assert.Equal(t, StatusClientClosedRequest, he.Code)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("handler did not return after the request was cancelled")
+	}
+	assert.ErrorIs(t, <-backend.errs, context.Canceled)
+	assert.ErrorIs(t, <-backend.errs, context.Canceled)
 }
 
 // TestFileResult tests the FileResult structure and its usage
@@ -0,0 +1,35 @@
+package gcsmiddlewaretest
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	gcsmiddleware "github.com/takumimas/echo-gcs-middleware"
+)
+
+// NewMiddleware builds the middleware from config with the store as its backend.
+// Any Backend already set in config is replaced.
+func NewMiddleware(store *Store, config gcsmiddleware.GCSStaticConfig) gcsmiddleware.StaticServerMiddlewareInterface {
+	config.Backend = store
+	return gcsmiddleware.NewGCSStaticMiddleware(config)
+}
+
+// NewEcho returns an Echo instance that serves the store through the middleware.
+// Routes can be registered on it to test how the middleware coexists with handlers.
+func NewEcho(store *Store, config gcsmiddleware.GCSStaticConfig) *echo.Echo {
+	e := echo.New()
+	e.HideBanner = true
+	e.HidePort = true
+	e.Use(NewMiddleware(store, config).ServerHeader)
+	return e
+}
+
+// NewServer starts an httptest.Server that serves the store through the middleware.
+// The server is closed when the test finishes.
+func NewServer(t testing.TB, store *Store, config gcsmiddleware.GCSStaticConfig) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(NewEcho(store, config))
+	t.Cleanup(server.Close)
+	return server
+}
@@ -0,0 +1,104 @@
+package gcsmiddlewaretest
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	gcsmiddleware "github.com/takumimas/echo-gcs-middleware"
+)
+
+// TestNewServer tests serving a store through an httptest server
+func TestNewServer(t *testing.T) {
+	store := NewStore()
+	store.PutString("index.html", "text/html", "<html>app</html>")
+	store.PutString("main.js", "application/javascript", "console.log(1)")
+
+	server := NewServer(t, store, gcsmiddleware.GCSStaticConfig{
+		RootPath: "/",
+	})
+
+	tests := []struct {
+		name       string
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "Existing object",
+			path:       "/main.js",
+			wantStatus: http.StatusOK,
+			wantBody:   "console.log(1)",
+		},
+		{
+			name:       "Missing object",
+			path:       "/missing.css",
+			wantStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Get(server.URL + tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Equal(t, tt.wantStatus, resp.StatusCode)
+			if tt.wantStatus == http.StatusOK {
+				assert.Equal(t, tt.wantBody, string(body))
+			}
+		})
+	}
+}
+
+// TestNewEcho tests that routes registered on the Echo instance can be ignored by the middleware
+func TestNewEcho(t *testing.T) {
+	store := NewStore()
+	e := NewEcho(store, gcsmiddleware.GCSStaticConfig{
+		RootPath:   "/",
+		IgnorePath: []string{"/healthz"},
+	})
+	e.GET("/healthz", func(c echo.Context) error {
+		return c.String(http.StatusOK, "ok")
+	})
+
+	server := httptest.NewServer(e)
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "ok", string(body))
+}
+
+// TestNewEchoZeroConfig tests that the helpers serve the store with a zero-value config
+func TestNewEchoZeroConfig(t *testing.T) {
+	store := NewStore()
+	store.PutString("main.js", "application/javascript", "console.log(1)")
+	e := NewEcho(store, gcsmiddleware.GCSStaticConfig{})
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/main.js", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "console.log(1)", rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/missing.css", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
@@ -0,0 +1,170 @@
+// Package gcsmiddlewaretest provides an in-process fake of a GCS bucket and helpers
+// for testing applications that use gcsmiddleware, without network access or credentials.
+package gcsmiddlewaretest
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"hash/crc32"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	gcsmiddleware "github.com/takumimas/echo-gcs-middleware"
+)
+
+// Object describes the contents and attributes of an object put into a Store
+type Object struct {
+	// Data is the content of the object
+	Data []byte
+
+	// ContentType is the MIME type stored with the object
+	ContentType string
+
+	// ContentEncoding is the encoding the object is stored with (e.g. "gzip")
+	ContentEncoding string
+
+	// Metadata holds user-provided metadata as key/value pairs
+	Metadata map[string]string
+}
+
+// storedObject is an object held by a Store together with its computed attributes
+type storedObject struct {
+	data  []byte
+	attrs gcsmiddleware.ObjectAttrs
+}
+
+// Store is an in-memory object store that implements gcsmiddleware.Backend.
+// Like a GCS bucket, every write creates a new generation of the object and
+// the size, CRC32C, MD5 and ETag are computed from its content.
+// It is safe for concurrent use.
+type Store struct {
+	mu         sync.RWMutex
+	objects    map[string]*storedObject
+	generation int64
+}
+
+// NewStore returns an empty Store
+func NewStore() *Store {
+	return &Store{
+		objects: make(map[string]*storedObject),
+	}
+}
+
+// Put stores the object under the given name, replacing any existing object,
+// and returns the attributes of the new generation.
+func (s *Store) Put(name string, object Object) gcsmiddleware.ObjectAttrs {
+	data := bytes.Clone(object.Data)
+	sum := md5.Sum(data)
+	metadata := make(map[string]string, len(object.Metadata))
+	for k, v := range object.Metadata {
+		metadata[k] = v
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.generation++
+	stored := &storedObject{
+		data: data,
+		attrs: gcsmiddleware.ObjectAttrs{
+			Name:            name,
+			ContentType:     object.ContentType,
+			ContentEncoding: object.ContentEncoding,
+			Size:            int64(len(data)),
+			Etag:            hex.EncodeToString(sum[:]),
+			Generation:      s.generation,
+			Updated:         time.Now().UTC().Truncate(time.Second),
+			CRC32C:          crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli)),
+			MD5:             sum[:],
+			Metadata:        metadata,
+		},
+	}
+	s.objects[name] = stored
+	return stored.attrs
+}
+
+// PutString stores a string as an object with the given content type
+func (s *Store) PutString(name, contentType, data string) gcsmiddleware.ObjectAttrs {
+	return s.Put(name, Object{
+		Data:        []byte(data),
+		ContentType: contentType,
+	})
+}
+
+// Delete removes the named object from the store
+func (s *Store) Delete(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, name)
+}
+
+// Stat returns the attributes of the named object
+func (s *Store) Stat(_ context.Context, name string) (*gcsmiddleware.ObjectAttrs, error) {
+	stored, err := s.get(name)
+	if err != nil {
+		return nil, err
+	}
+	attrs := stored.attrs
+	return &attrs, nil
+}
+
+// Open returns a reader for the full contents of the named object
+func (s *Store) Open(_ context.Context, name string) (io.ReadCloser, error) {
+	stored, err := s.get(name)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(stored.data)), nil
+}
+
+// OpenRange returns a reader for length bytes of the named object starting at offset
+func (s *Store) OpenRange(_ context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	stored, err := s.get(name)
+	if err != nil {
+		return nil, err
+	}
+	data := stored.data
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	data = data[offset:]
+	if length >= 0 && length < int64(len(data)) {
+		data = data[:length]
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// List returns the attributes of all objects whose names begin with prefix, sorted by name
+func (s *Store) List(_ context.Context, prefix string) ([]*gcsmiddleware.ObjectAttrs, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var objects []*gcsmiddleware.ObjectAttrs
+	for name, stored := range s.objects {
+		if strings.HasPrefix(name, prefix) {
+			attrs := stored.attrs
+			objects = append(objects, &attrs)
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Name < objects[j].Name
+	})
+	return objects, nil
+}
+
+// get looks up the named object
+func (s *Store) get(name string) (*storedObject, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stored, ok := s.objects[name]
+	if !ok {
+		return nil, gcsmiddleware.ErrObjectNotExist
+	}
+	return stored, nil
+}
@@ -0,0 +1,62 @@
+package gcsmiddlewaretest
+
+import (
+	"context"
+	"hash/crc32"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	gcsmiddleware "github.com/takumimas/echo-gcs-middleware"
+)
+
+// TestStore tests putting, reading, listing and deleting objects
+func TestStore(t *testing.T) {
+	store := NewStore()
+	ctx := context.Background()
+
+	first := store.PutString("css/style.css", "text/css", "body{}")
+	assert.Equal(t, int64(6), first.Size)
+	assert.Equal(t, crc32.Checksum([]byte("body{}"), crc32.MakeTable(crc32.Castagnoli)), first.CRC32C)
+	assert.Len(t, first.MD5, 16)
+	assert.NotEmpty(t, first.Etag)
+
+	second := store.Put("css/style.css", Object{
+		Data:        []byte("body{margin:0}"),
+		ContentType: "text/css",
+		Metadata:    map[string]string{"build": "42"},
+	})
+	assert.Greater(t, second.Generation, first.Generation)
+	assert.NotEqual(t, first.Etag, second.Etag)
+
+	attrs, err := store.Stat(ctx, "css/style.css")
+	assert.NoError(t, err)
+	assert.Equal(t, second, *attrs)
+	assert.Equal(t, "42", attrs.Metadata["build"])
+
+	reader, err := store.Open(ctx, "css/style.css")
+	assert.NoError(t, err)
+	data, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, "body{margin:0}", string(data))
+
+	reader, err = store.OpenRange(ctx, "css/style.css", 5, 6)
+	assert.NoError(t, err)
+	data, err = io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, "margin", string(data))
+
+	store.PutString("js/app.js", "application/javascript", "console.log(1)")
+	store.PutString("css/print.css", "text/css", "@media print{}")
+	objects, err := store.List(ctx, "css/")
+	assert.NoError(t, err)
+	assert.Len(t, objects, 2)
+	assert.Equal(t, "css/print.css", objects[0].Name)
+	assert.Equal(t, "css/style.css", objects[1].Name)
+
+	store.Delete("css/style.css")
+	_, err = store.Stat(ctx, "css/style.css")
+	assert.ErrorIs(t, err, gcsmiddleware.ErrObjectNotExist)
+	_, err = store.Open(ctx, "css/style.css")
+	assert.ErrorIs(t, err, gcsmiddleware.ErrObjectNotExist)
+}
@@ -0,0 +1,90 @@
+package gcsmiddleware
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// precompressedExtensions maps content encodings to the extension of the
+// precompressed copies of files
+var precompressedExtensions = map[string]string{
+	"br":   ".br",
+	"zstd": ".zst",
+	"gzip": ".gz",
+}
+
+// looksUpPrecompressed reports whether precompressed copies of the file are looked for
+func (s *FilesStore) looksUpPrecompressed(result FileResult) bool {
+	return s.config.ServePrecompressed && compressibleTypes[result.ContentType]
+}
+
+// findPrecompressed looks for a precompressed copy of the file in each encoding
+// acceptable to the client. The copies are looked up at once, so the lookups add a
+// single round trip to the backend, and the most preferred copy that exists is
+// returned along with its encoding. Range requests are always served from the file.
+func (s *FilesStore) findPrecompressed(c echo.Context, result FileResult) (FileResult, string, bool) {
+	if !s.looksUpPrecompressed(result) || c.Request().Header.Get("Range") != "" {
+		return FileResult{}, "", false
+	}
+	encodings, _ := negotiateEncodings(c.Request().Header)
+	if len(encodings) == 0 {
+		return FileResult{}, "", false
+	}
+	paths := make([]string, len(encodings))
+	for i, encoding := range encodings {
+		paths[i] = result.Path + precompressedExtensions[encoding]
+	}
+	chain := s.newFallbackChain(c.Request().Context(), paths, true)
+	defer chain.Close()
+
+	// A copy that cannot be looked up is ignored, as the file itself can still be served
+	i, sidecar := chain.firstExisting()
+	if i < 0 {
+		return FileResult{}, "", false
+	}
+	return sidecar, encodings[i], true
+}
+
+// servePrecompressed streams the precompressed copy of a file with the content type
+// of the file and the encoding of the copy. The ETag and Last-Modified headers are
+// those of the copy, as it is the representation being sent.
+func (s *FilesStore) servePrecompressed(c echo.Context, result, sidecar FileResult, encoding string) error {
+	header := c.Response().Header()
+	header.Set("Accept-Ranges", "bytes")
+	header.Add("Vary", "Accept-Encoding")
+	etag := entityTag(sidecar.Attrs, encoding)
+	if etag != "" {
+		header.Set("ETag", etag)
+	}
+	modtime := sidecar.Attrs.Updated
+	if !modtime.IsZero() {
+		header.Set("Last-Modified", modtime.UTC().Format(http.TimeFormat))
+	}
+	if result.Stale || sidecar.Stale {
+		header.Set("X-Cache", "STALE")
+		header.Set("Warning", staleWarning)
+	}
+
+	if handled, err := s.checkPreconditions(c, etag, modtime); handled {
+		return err
+	}
+	header.Set("Content-Encoding", encoding)
+	header.Set("Content-Length", strconv.FormatInt(sidecar.Size, 10))
+	if c.Request().Method == http.MethodHead {
+		header.Set("Content-Type", result.ContentType)
+		return c.NoContent(http.StatusOK)
+	}
+
+	reader, err := s.openReader(c.Request().Context(), func(ctx context.Context) (io.ReadCloser, error) {
+		return openGeneration(ctx, s.backend, sidecar.Path, sidecar.generation())
+	})
+	if err != nil {
+		return backendError(err)
+	}
+	defer reader.Close()
+	return c.Stream(http.StatusOK, result.ContentType, reader)
+}
@@ -0,0 +1,209 @@
+package gcsmiddleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestServerHeaderPrecompressed tests serving precompressed copies of files
+func TestServerHeaderPrecompressed(t *testing.T) {
+	body := strings.Repeat("console.log(1);", 100)
+	backend := &countingBackend{
+		Backend: memoryBackend{
+			"main.js":      []byte(body),
+			"main.js.br":   []byte("brotli bytes"),
+			"main.js.gz":   []byte("gzip bytes"),
+			"style.css":    []byte(body),
+			"style.css.gz": []byte("gzip bytes"),
+			"logo.png":     []byte(body),
+			"logo.png.gz":  []byte("gzip bytes"),
+		},
+	}
+	config := GCSStaticConfig{
+		Backend:            backend,
+		RootPath:           "/",
+		ServePrecompressed: true,
+		EnableCompression:  true,
+	}
+
+	tests := []struct {
+		name           string
+		method         string
+		target         string
+		acceptEncoding string
+		rangeHeader    string
+		wantEncoding   string
+		wantBody       string
+	}{
+		{
+			name:           "Preferred encoding",
+			target:         "/main.js",
+			acceptEncoding: "gzip, deflate, br, zstd",
+			wantEncoding:   "br",
+			wantBody:       "brotli bytes",
+		},
+		{
+			name:           "Quality values",
+			target:         "/main.js",
+			acceptEncoding: "br;q=0.5, gzip",
+			wantEncoding:   "gzip",
+			wantBody:       "gzip bytes",
+		},
+		{
+			name:           "Missing copy is compressed on the fly",
+			target:         "/style.css",
+			acceptEncoding: "br",
+			wantEncoding:   "br",
+		},
+		{
+			name:         "No accepted encoding",
+			target:       "/main.js",
+			wantBody:     body,
+			wantEncoding: "",
+		},
+		{
+			name:           "Range requests are served from the file",
+			target:         "/main.js",
+			acceptEncoding: "br",
+			rangeHeader:    "bytes=0-6",
+			wantBody:       "console",
+		},
+		{
+			name:           "Files that are not compressible",
+			target:         "/logo.png",
+			acceptEncoding: "gzip",
+			wantBody:       body,
+		},
+		{
+			name:           "HEAD",
+			method:         http.MethodHead,
+			target:         "/main.js",
+			acceptEncoding: "br",
+			wantEncoding:   "br",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			req := httptest.NewRequest(method, tt.target, nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			if tt.rangeHeader != "" {
+				req.Header.Set("Range", tt.rangeHeader)
+			}
+			rec := serve(config, req)
+
+			assert.Less(t, rec.Code, 300)
+			assert.Equal(t, tt.wantEncoding, rec.Header().Get(echo.HeaderContentEncoding))
+			if tt.wantBody != "" {
+				assert.Equal(t, tt.wantBody, rec.Body.String())
+				assert.Equal(t, strconv.Itoa(len(tt.wantBody)), rec.Header().Get(echo.HeaderContentLength))
+			}
+			if tt.target != "/logo.png" {
+				assert.Equal(t, "Accept-Encoding", rec.Header().Get(echo.HeaderVary))
+			}
+		})
+	}
+
+	t.Run("Content type and length of the file", func(t *testing.T) {
+		for _, method := range []string{http.MethodGet, http.MethodHead} {
+			req := httptest.NewRequest(method, "/main.js", nil)
+			req.Header.Set("Accept-Encoding", "br")
+			rec := serve(config, req)
+
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, "application/javascript", rec.Header().Get(echo.HeaderContentType))
+			assert.Equal(t, strconv.Itoa(len("brotli bytes")), rec.Header().Get(echo.HeaderContentLength))
+		}
+	})
+
+	t.Run("Copies are streamed regardless of their size", func(t *testing.T) {
+		config := config
+		config.StreamThreshold = 10
+		req := httptest.NewRequest(http.MethodGet, "/main.js", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rec := serve(config, req)
+
+		assert.Equal(t, "gzip", rec.Header().Get(echo.HeaderContentEncoding))
+		assert.Equal(t, "gzip bytes", rec.Body.String())
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		config := config
+		config.ServePrecompressed = false
+		backend.stats.Store(0)
+		req := httptest.NewRequest(http.MethodGet, "/main.js", nil)
+		req.Header.Set("Accept-Encoding", "br")
+		rec := serve(config, req)
+
+		assert.Equal(t, "br", rec.Header().Get(echo.HeaderContentEncoding))
+		assert.NotEqual(t, "brotli bytes", rec.Body.String())
+		assert.Equal(t, int32(1), backend.stats.Load())
+	})
+}
+
+// barrierBackend is a memoryBackend whose lookups of precompressed copies only
+// complete once all of them are running, or time out otherwise
+type barrierBackend struct {
+	memoryBackend
+	copies  int32
+	started atomic.Int32
+	all     chan struct{}
+}
+
+func (b *barrierBackend) Stat(ctx context.Context, name string) (*ObjectAttrs, error) {
+	if path.Ext(name) == ".js" {
+		return b.memoryBackend.Stat(ctx, name)
+	}
+	if b.started.Add(1) == b.copies {
+		close(b.all)
+	}
+	select {
+	case <-b.all:
+		return b.memoryBackend.Stat(ctx, name)
+	case <-time.After(time.Second):
+		return nil, ErrTimeout
+	}
+}
+
+// TestServerHeaderPrecompressedParallel tests that the precompressed copies of a
+// file are looked up at once and the most preferred one is served
+func TestServerHeaderPrecompressedParallel(t *testing.T) {
+	backend := &barrierBackend{
+		memoryBackend: memoryBackend{
+			"main.js":    []byte(strings.Repeat("console.log(1);", 100)),
+			"main.js.br": []byte("brotli bytes"),
+			"main.js.gz": []byte("gzip bytes"),
+		},
+		copies: 3,
+		all:    make(chan struct{}),
+	}
+	config := GCSStaticConfig{
+		Backend:            backend,
+		RootPath:           "/",
+		ServePrecompressed: true,
+	}
+	req := httptest.NewRequest(http.MethodGet, "/main.js", nil)
+	req.Header.Set("Accept-Encoding", "gzip, zstd, br")
+	rec := serve(config, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "br", rec.Header().Get("Content-Encoding"))
+	assert.Equal(t, "brotli bytes", rec.Body.String())
+	assert.Equal(t, int32(3), backend.started.Load())
+}
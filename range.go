@@ -0,0 +1,269 @@
+package gcsmiddleware
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// errNoOverlap is returned by parseRange if none of the ranges overlap the file
+var errNoOverlap = errors.New("invalid range: failed to overlap")
+
+// httpRange specifies the byte range to be sent to the client
+type httpRange struct {
+	start, length int64
+}
+
+// contentRange returns the value of the Content-Range header for the range
+func (r httpRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// mimeHeader returns the headers of the multipart/byteranges part for the range
+func (r httpRange) mimeHeader(contentType string, size int64) textproto.MIMEHeader {
+	return textproto.MIMEHeader{
+		"Content-Range": {r.contentRange(size)},
+		"Content-Type":  {contentType},
+	}
+}
+
+// parseRange parses a Range header string as per RFC 9110.
+// It returns errNoOverlap if the header is valid but none of the ranges can be satisfied.
+func parseRange(s string, size int64) ([]httpRange, error) {
+	const b = "bytes="
+	if !strings.HasPrefix(s, b) {
+		return nil, errors.New("invalid range")
+	}
+	var ranges []httpRange
+	noOverlap := false
+	for _, ra := range strings.Split(s[len(b):], ",") {
+		ra = textproto.TrimString(ra)
+		if ra == "" {
+			continue
+		}
+		start, end, ok := strings.Cut(ra, "-")
+		if !ok {
+			return nil, errors.New("invalid range")
+		}
+		start, end = textproto.TrimString(start), textproto.TrimString(end)
+		var r httpRange
+		if start == "" {
+			// If no start is specified, end specifies the range start relative
+			// to the end of the file, and we are dealing with <suffix-length>
+			// which has to be a non-negative integer as per RFC 9110 Section 14.1.1.
+			if end == "" || end[0] == '-' {
+				return nil, errors.New("invalid range")
+			}
+			i, err := strconv.ParseInt(end, 10, 64)
+			if i < 0 || err != nil {
+				return nil, errors.New("invalid range")
+			}
+			if i == 0 {
+				noOverlap = true
+				continue
+			}
+			if i > size {
+				i = size
+			}
+			r.start = size - i
+			r.length = size - r.start
+		} else {
+			i, err := strconv.ParseInt(start, 10, 64)
+			if err != nil || i < 0 {
+				return nil, errors.New("invalid range")
+			}
+			if i >= size {
+				// If the range begins after the size of the content,
+				// then it does not overlap.
+				noOverlap = true
+				continue
+			}
+			r.start = i
+			if end == "" {
+				// If no end is specified, range extends to end of the file.
+				r.length = size - r.start
+			} else {
+				i, err := strconv.ParseInt(end, 10, 64)
+				if err != nil || r.start > i {
+					return nil, errors.New("invalid range")
+				}
+				if i >= size {
+					i = size - 1
+				}
+				r.length = i - r.start + 1
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	if noOverlap && len(ranges) == 0 {
+		// The specified ranges did not overlap with the content.
+		return nil, errNoOverlap
+	}
+	return ranges, nil
+}
+
+// sumRangesSize returns the total number of bytes covered by the ranges
+func sumRangesSize(ranges []httpRange) (size int64) {
+	for _, ra := range ranges {
+		size += ra.length
+	}
+	return size
+}
+
+// maxRanges is the number of ranges, after coalescing, above which a request is
+// answered with the full file. Every range is a separate read from the backend.
+const maxRanges = 16
+
+// coalesceRanges sorts the ranges by their start and merges the ones that
+// overlap or are adjacent, as allowed by RFC 9110 Section 14.2
+func coalesceRanges(ranges []httpRange) []httpRange {
+	sorted := slices.Clone(ranges)
+	slices.SortFunc(sorted, func(a, b httpRange) int {
+		return cmp.Compare(a.start, b.start)
+	})
+	merged := sorted[:1]
+	for _, ra := range sorted[1:] {
+		last := &merged[len(merged)-1]
+		if ra.start > last.start+last.length {
+			merged = append(merged, ra)
+			continue
+		}
+		last.length = max(last.length, ra.start+ra.length-last.start)
+	}
+	return merged
+}
+
+// countingWriter counts the number of bytes written to it
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (n int, err error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
+
+// rangesMIMESize returns the number of bytes it takes to encode the provided
+// ranges as a multipart/byteranges response with the given boundary
+func rangesMIMESize(ranges []httpRange, boundary, contentType string, size int64) int64 {
+	var w countingWriter
+	mw := multipart.NewWriter(&w)
+	mw.SetBoundary(boundary)
+	for _, ra := range ranges {
+		mw.CreatePart(ra.mimeHeader(contentType, size))
+	}
+	mw.Close()
+	return int64(w) + sumRangesSize(ranges)
+}
+
+// checkIfRange reports whether the ranges of the request should be served.
+// A request without If-Range always gets its ranges. Otherwise the ranges are only
+// served if the validator still matches the file; if the file has changed, the
+// full file is sent instead.
+func checkIfRange(req *http.Request, attrs *ObjectAttrs) bool {
+	ir := req.Header.Get("If-Range")
+	if ir == "" {
+		return true
+	}
+	if etag, _ := scanETag(ir); etag != "" {
+		// Ranges are always served from the identity representation
+		return etagStrongMatch(etag, entityTag(attrs, ""))
+	}
+	t, err := http.ParseTime(ir)
+	if err != nil || attrs == nil || attrs.Updated.IsZero() {
+		return false
+	}
+	return attrs.Updated.Truncate(time.Second).Equal(t)
+}
+
+// serveRange answers a GET request carrying a Range header with the requested
+// bytes of the file. A single range is sent as a 206 Partial Content response,
+// multiple ranges as a multipart/byteranges response, and ranges that do not
+// overlap the file as 416 Range Not Satisfiable. Overlapping and adjacent ranges
+// are merged, and requests with more than maxRanges ranges get the full file.
+//
+// It reports false if the request has to be answered with the full file instead,
+// either because it has no usable Range header or because If-Range did not match.
+func (s *FilesStore) serveRange(c echo.Context, fileResult FileResult) (bool, error) {
+	req := c.Request()
+	rangeHeader := req.Header.Get("Range")
+	if rangeHeader == "" || req.Method != http.MethodGet || !checkIfRange(req, fileResult.Attrs) {
+		return false, nil
+	}
+
+	ranges, err := parseRange(rangeHeader, fileResult.Size)
+	if errors.Is(err, errNoOverlap) {
+		c.Response().Header().Set("Content-Range", fmt.Sprintf("bytes */%d", fileResult.Size))
+		return true, c.NoContent(http.StatusRequestedRangeNotSatisfiable)
+	}
+	// Invalid headers and ranges covering more than the file are ignored
+	if err != nil || len(ranges) == 0 || sumRangesSize(ranges) > fileResult.Size {
+		return false, nil
+	}
+	ranges = coalesceRanges(ranges)
+	if len(ranges) > maxRanges {
+		return false, nil
+	}
+
+	open := func(ra httpRange) (io.ReadCloser, error) {
+		return s.openReader(req.Context(), func(ctx context.Context) (io.ReadCloser, error) {
+			return openRangeGeneration(ctx, s.backend, fileResult.Path, fileResult.generation(), ra.start, ra.length)
+		})
+	}
+	// Open the first range before writing the status so a failing backend can
+	// still be reported. The other ranges are opened one at a time as they are sent.
+	first, err := open(ranges[0])
+	if err != nil {
+		return true, backendError(err)
+	}
+	defer first.Close()
+
+	if len(ranges) == 1 {
+		ra := ranges[0]
+		c.Response().Header().Set("Content-Range", ra.contentRange(fileResult.Size))
+		c.Response().Header().Set("Content-Length", strconv.FormatInt(ra.length, 10))
+		return true, c.Stream(http.StatusPartialContent, fileResult.ContentType, first)
+	}
+
+	mw := multipart.NewWriter(c.Response())
+	boundary := mw.Boundary()
+	c.Response().Header().Set("Content-Type", "multipart/byteranges; boundary="+boundary)
+	c.Response().Header().Set("Content-Length",
+		strconv.FormatInt(rangesMIMESize(ranges, boundary, fileResult.ContentType, fileResult.Size), 10))
+	c.Response().WriteHeader(http.StatusPartialContent)
+	for i, ra := range ranges {
+		part, err := mw.CreatePart(ra.mimeHeader(fileResult.ContentType, fileResult.Size))
+		if err != nil {
+			return true, err
+		}
+		if err := copyRange(part, ra, i, first, open); err != nil {
+			return true, err
+		}
+	}
+	return true, mw.Close()
+}
+
+// copyRange copies the i-th range of a multipart response to w. The first range
+// has been opened already, the others are opened with open and closed once copied.
+func copyRange(w io.Writer, ra httpRange, i int, first io.Reader, open func(httpRange) (io.ReadCloser, error)) error {
+	if i == 0 {
+		_, err := io.Copy(w, first)
+		return err
+	}
+	reader, err := open(ra)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	_, err = io.Copy(w, reader)
+	return err
+}
@@ -0,0 +1,375 @@
+package gcsmiddleware
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestParseRange tests parsing of Range headers
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		size    int64
+		want    []httpRange
+		wantErr error
+		invalid bool
+	}{
+		{
+			name:   "First bytes",
+			header: "bytes=0-9",
+			size:   100,
+			want:   []httpRange{{start: 0, length: 10}},
+		},
+		{
+			name:   "Open-ended range",
+			header: "bytes=90-",
+			size:   100,
+			want:   []httpRange{{start: 90, length: 10}},
+		},
+		{
+			name:   "Suffix range",
+			header: "bytes=-5",
+			size:   100,
+			want:   []httpRange{{start: 95, length: 5}},
+		},
+		{
+			name:   "Suffix longer than the file",
+			header: "bytes=-500",
+			size:   100,
+			want:   []httpRange{{start: 0, length: 100}},
+		},
+		{
+			name:   "End beyond the file",
+			header: "bytes=50-500",
+			size:   100,
+			want:   []httpRange{{start: 50, length: 50}},
+		},
+		{
+			name:   "Multiple ranges with whitespace",
+			header: "bytes=0-0, 10-19 ,-1",
+			size:   100,
+			want:   []httpRange{{start: 0, length: 1}, {start: 10, length: 10}, {start: 99, length: 1}},
+		},
+		{
+			name:   "Unsatisfiable range next to a satisfiable one",
+			header: "bytes=200-300,0-1",
+			size:   100,
+			want:   []httpRange{{start: 0, length: 2}},
+		},
+		{
+			name:    "Start beyond the file",
+			header:  "bytes=100-",
+			size:    100,
+			wantErr: errNoOverlap,
+		},
+		{
+			name:    "Zero suffix",
+			header:  "bytes=-0",
+			size:    100,
+			wantErr: errNoOverlap,
+		},
+		{
+			name:    "Other unit",
+			header:  "items=0-1",
+			size:    100,
+			invalid: true,
+		},
+		{
+			name:    "End before start",
+			header:  "bytes=10-5",
+			size:    100,
+			invalid: true,
+		},
+		{
+			name:    "Missing dash",
+			header:  "bytes=10",
+			size:    100,
+			invalid: true,
+		},
+		{
+			name:    "Negative suffix",
+			header:  "bytes=--5",
+			size:    100,
+			invalid: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRange(tt.header, tt.size)
+			switch {
+			case tt.wantErr != nil:
+				assert.ErrorIs(t, err, tt.wantErr)
+			case tt.invalid:
+				assert.Error(t, err)
+				assert.NotErrorIs(t, err, errNoOverlap)
+			default:
+				assert.NoError(t, err)
+				assert.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
+
+// TestServerHeaderRange tests responses to Range requests
+func TestServerHeaderRange(t *testing.T) {
+	body := "0123456789abcdefghijklmnopqrstuvwxyz"
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	config := GCSStaticConfig{
+		Backend: NewFSBackend(fstest.MapFS{
+			"video.mp4": {Data: []byte(body), ModTime: modTime},
+		}),
+		RootPath: "/",
+	}
+
+	tests := []struct {
+		name         string
+		header       http.Header
+		wantStatus   int
+		wantBody     string
+		contentRange string
+	}{
+		{
+			name:       "No range",
+			wantStatus: http.StatusOK,
+			wantBody:   body,
+		},
+		{
+			name:         "Single range",
+			header:       http.Header{"Range": {"bytes=10-15"}},
+			wantStatus:   http.StatusPartialContent,
+			wantBody:     "abcdef",
+			contentRange: "bytes 10-15/36",
+		},
+		{
+			name:         "Suffix range",
+			header:       http.Header{"Range": {"bytes=-3"}},
+			wantStatus:   http.StatusPartialContent,
+			wantBody:     "xyz",
+			contentRange: "bytes 33-35/36",
+		},
+		{
+			name:         "Unsatisfiable range",
+			header:       http.Header{"Range": {"bytes=100-"}},
+			wantStatus:   http.StatusRequestedRangeNotSatisfiable,
+			contentRange: "bytes */36",
+		},
+		{
+			name:       "Invalid range is ignored",
+			header:     http.Header{"Range": {"bytes=5-1"}},
+			wantStatus: http.StatusOK,
+			wantBody:   body,
+		},
+		{
+			name:       "Ranges larger than the file are ignored",
+			header:     http.Header{"Range": {"bytes=0-,0-,0-"}},
+			wantStatus: http.StatusOK,
+			wantBody:   body,
+		},
+		{
+			name: "If-Range with matching date",
+			header: http.Header{
+				"Range":    {"bytes=0-1"},
+				"If-Range": {modTime.Format(http.TimeFormat)},
+			},
+			wantStatus:   http.StatusPartialContent,
+			wantBody:     "01",
+			contentRange: "bytes 0-1/36",
+		},
+		{
+			name: "If-Range with outdated date",
+			header: http.Header{
+				"Range":    {"bytes=0-1"},
+				"If-Range": {modTime.Add(-time.Hour).Format(http.TimeFormat)},
+			},
+			wantStatus: http.StatusOK,
+			wantBody:   body,
+		},
+		{
+			name: "If-Range with matching entity tag",
+			header: http.Header{
+				"Range":    {"bytes=2-3"},
+				"If-Range": {entityTag(&ObjectAttrs{Generation: modTime.UnixNano()}, "")},
+			},
+			wantStatus:   http.StatusPartialContent,
+			wantBody:     "23",
+			contentRange: "bytes 2-3/36",
+		},
+		{
+			name: "If-Range with unknown entity tag",
+			header: http.Header{
+				"Range":    {"bytes=0-1"},
+				"If-Range": {`"abc"`},
+			},
+			wantStatus: http.StatusOK,
+			wantBody:   body,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/video.mp4", nil)
+			for k, v := range tt.header {
+				req.Header[k] = v
+			}
+			rec := serve(config, req)
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			assert.Equal(t, "bytes", rec.Header().Get("Accept-Ranges"))
+			assert.Equal(t, tt.contentRange, rec.Header().Get("Content-Range"))
+			if tt.wantBody != "" {
+				assert.Equal(t, tt.wantBody, rec.Body.String())
+			}
+		})
+	}
+}
+
+// TestServerHeaderMultipartRange tests multipart/byteranges responses
+func TestServerHeaderMultipartRange(t *testing.T) {
+	body := "0123456789abcdefghijklmnopqrstuvwxyz"
+	config := GCSStaticConfig{
+		Backend:  memoryBackend{"doc.pdf": []byte(body)},
+		RootPath: "/",
+	}
+	req := httptest.NewRequest(http.MethodGet, "/doc.pdf", nil)
+	req.Header.Set("Range", "bytes=0-2,10-12,-2")
+	rec := serve(config, req)
+
+	assert.Equal(t, http.StatusPartialContent, rec.Code)
+	assert.Equal(t, strconv.Itoa(rec.Body.Len()), rec.Header().Get("Content-Length"))
+
+	mediaType, params, err := mime.ParseMediaType(rec.Header().Get("Content-Type"))
+	assert.NoError(t, err)
+	assert.Equal(t, "multipart/byteranges", mediaType)
+
+	reader := multipart.NewReader(rec.Body, params["boundary"])
+	want := []struct {
+		contentRange string
+		body         string
+	}{
+		{"bytes 0-2/36", "012"},
+		{"bytes 10-12/36", "abc"},
+		{"bytes 34-35/36", "yz"},
+	}
+	for _, w := range want {
+		part, err := reader.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(part)
+		assert.NoError(t, err)
+		assert.Equal(t, "application/pdf", part.Header.Get("Content-Type"))
+		assert.Equal(t, w.contentRange, part.Header.Get("Content-Range"))
+		assert.Equal(t, w.body, string(data))
+	}
+	_, err = reader.NextPart()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+// TestServerHeaderRangeLimits tests that ranges are merged and capped, and that
+// each served range costs a single read from the backend
+func TestServerHeaderRangeLimits(t *testing.T) {
+	body := "0123456789abcdefghijklmnopqrstuvwxyz"
+	manyRanges := make([]string, 0, maxRanges+1)
+	for i := 0; i <= maxRanges; i++ {
+		manyRanges = append(manyRanges, fmt.Sprintf("%d-%d", i*2, i*2))
+	}
+
+	tests := []struct {
+		name         string
+		rangeHeader  string
+		wantStatus   int
+		wantBody     string
+		contentRange string
+		wantOpens    int32
+	}{
+		{
+			name:         "Adjacent ranges are merged",
+			rangeHeader:  "bytes=0-0,1-1,2-2",
+			wantStatus:   http.StatusPartialContent,
+			wantBody:     "012",
+			contentRange: "bytes 0-2/36",
+			wantOpens:    1,
+		},
+		{
+			name:         "Overlapping ranges are merged",
+			rangeHeader:  "bytes=10-15,5-12",
+			wantStatus:   http.StatusPartialContent,
+			wantBody:     "56789abcdef",
+			contentRange: "bytes 5-15/36",
+			wantOpens:    1,
+		},
+		{
+			name:        "Separate ranges are opened one by one",
+			rangeHeader: "bytes=0-2,10-12,-2",
+			wantStatus:  http.StatusPartialContent,
+			wantOpens:   3,
+		},
+		{
+			name:        "Too many ranges get the full file",
+			rangeHeader: "bytes=" + strings.Join(manyRanges, ","),
+			wantStatus:  http.StatusOK,
+			wantBody:    body,
+			wantOpens:   1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := &countingBackend{Backend: memoryBackend{"doc.pdf": []byte(body)}}
+			config := GCSStaticConfig{Backend: backend, RootPath: "/"}
+			req := httptest.NewRequest(http.MethodGet, "/doc.pdf", nil)
+			req.Header.Set("Range", tt.rangeHeader)
+			rec := serve(config, req)
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			assert.Equal(t, tt.contentRange, rec.Header().Get("Content-Range"))
+			if tt.wantBody != "" {
+				assert.Equal(t, tt.wantBody, rec.Body.String())
+			}
+			assert.Equal(t, tt.wantOpens, backend.opens.Load())
+		})
+	}
+}
+
+// TestOpenRange tests reading ranges from every backend, including the fallback
+// for backends that do not implement RangeBackend
+func TestOpenRange(t *testing.T) {
+	body := []byte("0123456789")
+	dir := t.TempDir()
+	writeTestFiles(t, dir, map[string][]byte{"file.bin": body})
+
+	backends := map[string]Backend{
+		"memory": memoryBackend{"file.bin": body},
+		"local":  NewLocalBackend(dir),
+		"fs":     NewFSBackend(fstest.MapFS{"file.bin": {Data: body}}),
+	}
+	for name, backend := range backends {
+		t.Run(name, func(t *testing.T) {
+			reader, err := openRange(context.Background(), backend, "file.bin", 3, 4)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := io.ReadAll(reader)
+			assert.NoError(t, err)
+			assert.NoError(t, reader.Close())
+			assert.Equal(t, "3456", string(data))
+
+			_, err = openRange(context.Background(), backend, "missing.bin", 0, 1)
+			assert.ErrorIs(t, err, ErrObjectNotExist)
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package gcsmiddleware
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/labstack/echo/v4"
+)
+
+// storedEncoding returns the content encoding a file is stored with, such as
+// "gzip" for objects uploaded with `gsutil cp -Z`, or "" if the file is not
+// stored in an encoding the middleware can decode
+func storedEncoding(result FileResult) string {
+	if result.Attrs == nil {
+		return ""
+	}
+	encoding := strings.ToLower(strings.TrimSpace(result.Attrs.ContentEncoding))
+	if !slices.Contains(supportedEncodings, encoding) {
+		return ""
+	}
+	return encoding
+}
+
+// serveStoredEncoded serves a file that is stored compressed. Clients that accept
+// its encoding receive the stored bytes as they are, with the stored size as
+// Content-Length. For all other clients the file is decoded while it is streamed,
+// and Content-Length is omitted as the decoded size is unknown. The file is never
+// compressed again, and range requests are answered with the whole file, as the
+// stored bytes cannot be mapped to ranges of the decoded content.
+func (s *FilesStore) serveStoredEncoded(c echo.Context, result FileResult) error {
+	encoding := storedEncoding(result)
+	encodings, identity := negotiateEncodings(c.Request().Header)
+	passThrough := slices.Contains(encodings, encoding)
+
+	header := c.Response().Header()
+	header.Add("Vary", "Accept-Encoding")
+	if !passThrough && !identity {
+		return c.NoContent(http.StatusNotAcceptable)
+	}
+	// The stored bytes are the encoded representation, so the decoded one gets its own tag
+	etag := entityTag(result.Attrs, "")
+	if !passThrough {
+		etag = entityTag(result.Attrs, "identity")
+	}
+	if etag != "" {
+		header.Set("ETag", etag)
+	}
+	modtime := result.Attrs.Updated
+	if !modtime.IsZero() {
+		header.Set("Last-Modified", modtime.UTC().Format(http.TimeFormat))
+	}
+	if result.Stale {
+		header.Set("X-Cache", "STALE")
+		header.Set("Warning", staleWarning)
+	}
+
+	if handled, err := s.checkPreconditions(c, etag, modtime); handled {
+		return err
+	}
+	if passThrough {
+		header.Set("Content-Encoding", encoding)
+		header.Set("Content-Length", strconv.FormatInt(result.Size, 10))
+	}
+	if c.Request().Method == http.MethodHead {
+		header.Set("Content-Type", result.ContentType)
+		return c.NoContent(http.StatusOK)
+	}
+
+	reader, err := s.openReader(c.Request().Context(), func(ctx context.Context) (io.ReadCloser, error) {
+		return openGeneration(ctx, s.backend, result.Path, result.generation())
+	})
+	if err != nil {
+		return backendError(err)
+	}
+	defer reader.Close()
+	if passThrough {
+		return c.Stream(http.StatusOK, result.ContentType, reader)
+	}
+
+	decoder, err := newDecoder(encoding, reader)
+	if err != nil {
+		return backendError(err)
+	}
+	defer decoder.Close()
+	return c.Stream(http.StatusOK, result.ContentType, decoder)
+}
+
+// newDecoder returns a reader of the content of r decoded from the given encoding.
+// Closing it releases the decoder but does not close r.
+func newDecoder(encoding string, r io.Reader) (io.ReadCloser, error) {
+	switch encoding {
+	case "gzip":
+		return gzip.NewReader(r)
+	case "br":
+		return io.NopCloser(brotli.NewReader(r)), nil
+	case "zstd":
+		decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("unsupported encoding: %s", encoding)
+	}
+}
@@ -0,0 +1,126 @@
+package gcsmiddleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestServerHeaderStoredEncoding tests serving objects stored with Content-Encoding: gzip
+func TestServerHeaderStoredEncoding(t *testing.T) {
+	body := strings.Repeat("console.log(1);", 100)
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(body))
+	gz.Close()
+	stored := buf.String()
+
+	backend := attrsBackend{
+		memoryBackend: memoryBackend{"app.js": []byte(stored)},
+		attrs:         ObjectAttrs{ContentEncoding: "gzip", MD5: []byte{0x01, 0x02, 0x03}},
+	}
+	config := GCSStaticConfig{
+		Backend:           backend,
+		RootPath:          "/",
+		EnableCompression: true,
+	}
+
+	tests := []struct {
+		name           string
+		method         string
+		acceptEncoding string
+		rangeHeader    string
+		wantStatus     int
+		wantEncoding   string
+		wantLength     string
+		wantETag       string
+		wantBody       string
+	}{
+		{
+			name:           "Client accepting gzip",
+			acceptEncoding: "gzip, deflate, br",
+			wantStatus:     http.StatusOK,
+			wantEncoding:   "gzip",
+			wantLength:     strconv.Itoa(len(stored)),
+			wantETag:       `"010203"`,
+			wantBody:       stored,
+		},
+		{
+			name:       "Client not accepting gzip",
+			wantStatus: http.StatusOK,
+			wantETag:   `"010203-identity"`,
+			wantBody:   body,
+		},
+		{
+			name:           "Client accepting only another encoding",
+			acceptEncoding: "br",
+			wantStatus:     http.StatusOK,
+			wantETag:       `"010203-identity"`,
+			wantBody:       body,
+		},
+		{
+			name:           "Range requests get the whole file",
+			acceptEncoding: "gzip",
+			rangeHeader:    "bytes=0-9",
+			wantStatus:     http.StatusOK,
+			wantEncoding:   "gzip",
+			wantLength:     strconv.Itoa(len(stored)),
+			wantETag:       `"010203"`,
+			wantBody:       stored,
+		},
+		{
+			name:           "HEAD with gzip",
+			method:         http.MethodHead,
+			acceptEncoding: "gzip",
+			wantStatus:     http.StatusOK,
+			wantEncoding:   "gzip",
+			wantLength:     strconv.Itoa(len(stored)),
+			wantETag:       `"010203"`,
+		},
+		{
+			name:       "HEAD without gzip",
+			method:     http.MethodHead,
+			wantStatus: http.StatusOK,
+			wantETag:   `"010203-identity"`,
+		},
+		{
+			name:           "Nothing acceptable",
+			acceptEncoding: "br, identity;q=0",
+			wantStatus:     http.StatusNotAcceptable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			req := httptest.NewRequest(method, "/app.js", nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			if tt.rangeHeader != "" {
+				req.Header.Set("Range", tt.rangeHeader)
+			}
+			rec := serve(config, req)
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			assert.Equal(t, tt.wantEncoding, rec.Header().Get(echo.HeaderContentEncoding))
+			assert.Equal(t, tt.wantLength, rec.Header().Get(echo.HeaderContentLength))
+			assert.Equal(t, tt.wantETag, rec.Header().Get("ETag"))
+			assert.Equal(t, "Accept-Encoding", rec.Header().Get(echo.HeaderVary))
+			assert.Equal(t, tt.wantBody, rec.Body.String())
+			if tt.wantStatus == http.StatusOK {
+				assert.Equal(t, "application/javascript", rec.Header().Get(echo.HeaderContentType))
+			}
+		})
+	}
+}